@@ -1,19 +1,30 @@
 package configs
 
-import "os"
-
 type TlsConfig struct {
 	Cert string
 	Key  string
 	Port string
 
+	Certificates []CertificateConfig /// optional - more certificates, presented to clients asking for their names (SNI)
+	CertPoll     string              /// how often to check the certificate files for renewals, defaults to 1m, 0s to never
+
 	IsHttps    bool /// one of these must be set
 	IsProxy    bool
 	IsTlsProxy bool /// it seems we're getting data prior to the tls handshake
 	IsTcpProxy bool
 }
 
+type CertificateConfig struct {
+	Cert string
+	Key  string
+}
+
 func (t *TlsConfig) Expand() {
-	t.Cert = os.ExpandEnv(t.Cert)
-	t.Key = os.ExpandEnv(t.Key)
+	t.Cert = Expand(t.Cert)
+	t.Key = Expand(t.Key)
+	for i := range t.Certificates {
+		t.Certificates[i].Cert = Expand(t.Certificates[i].Cert)
+		t.Certificates[i].Key = Expand(t.Certificates[i].Key)
+	}
+	t.CertPoll = Expand(t.CertPoll)
 }
@@ -0,0 +1,59 @@
+package configs
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// / Expand a config value's environment variables. As os.ExpandEnv, plus the shell's
+// / ${VAR:-default} for when VAR is unset or empty (${VAR-default} when unset) and
+// / ${VAR:?message} to refuse to start when it is (${VAR?message} when unset).
+func Expand(value string) string {
+	return os.Expand(value, func(name string) string {
+		/// only ${...} can hold an operator after a name - a bare $? or $- is a one character name, as
+		/// os.ExpandEnv has it, so a secret with a $ in it keeps expanding the way it always did
+		i := strings.IndexAny(name, ":-?")
+		if i <= 0 {
+			return os.Getenv(name)
+		}
+		variable, op := name[:i], name[i:]
+		emptyisunset := strings.HasPrefix(op, ":")
+		op = strings.TrimPrefix(op, ":")
+		if op == "" || (op[0] != '-' && op[0] != '?') {
+			return os.Getenv(name)
+		}
+		if val, set := os.LookupEnv(variable); set && (val != "" || !emptyisunset) {
+			return val
+		}
+		if op[0] == '-' {
+			return op[1:]
+		}
+		message := op[1:]
+		if message == "" && emptyisunset {
+			message = "not set or empty"
+		} else if message == "" {
+			message = "not set"
+		}
+		log.Panicln("Environment variable", variable+":", message)
+		return ""
+	})
+}
+
+// / Expand a secret - a proxy key, a tunnel Paramval. It can be file:<path> to read it from a file,
+// / as docker and kubernetes mount secrets, with the path expanded first and any trailing newline
+// / dropped. A secret that comes out empty panics rather than quietly matching or sending "".
+func ExpandSecret(value string, what string) string {
+	expanded := Expand(value)
+	if path, ok := strings.CutPrefix(expanded, "file:"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Panicln("Unable to read", what, "from", path, err)
+		}
+		expanded = strings.TrimRight(string(data), "\r\n")
+	}
+	if expanded == "" {
+		log.Panicln(what, value, "is empty once expanded")
+	}
+	return expanded
+}
@@ -2,13 +2,35 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"hdnprxy/service"
+	"os"
 )
 
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: hdnprxy --config <dir|file.yaml|file.json>")
+	fmt.Fprintln(os.Stderr, "       hdnprxy check --config <dir|file>")
+	fmt.Fprintln(os.Stderr, "       hdnprxy convert --config <dir> [--out file.yaml|file.json]")
+	fmt.Fprintln(os.Stderr, "       hdnprxy rules test --config <dir> [--ruleset name | --key key] [--at time] [allow|deny|drop|block=]host:port ...")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(service.RunCheck(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		os.Exit(service.RunConvert(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		if len(os.Args) < 3 || os.Args[2] != "test" {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(service.RunRulesTest(os.Args[3:], os.Stdin, os.Stdout))
+	}
 
 	cfgpath := ""
-	flag.StringVar(&cfgpath, "config", "", "Path to the configuration file(s)")
+	flag.StringVar(&cfgpath, "config", "", "Path to the configuration directory, or a single yaml or json config file")
 	flag.Parse()
 
 	///Start the service
@@ -5,7 +5,9 @@ import (
 	"github.com/299m/util/util"
 	"hdnprxy/relay"
 	"hdnprxy/rules"
+	"log"
 	"sync/atomic"
+	"time"
 )
 
 type Config struct {
@@ -20,6 +22,13 @@ func (c *Config) Expand() {
 
 var engineid int64
 
+// / A north relay that doesn't connect until it knows where the session is going
+type Router interface {
+	Route(target string) error
+}
+
+var badGateway = []byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
 type Engine struct {
 	north     relay.Relay
 	south     relay.Relay
@@ -28,6 +37,15 @@ type Engine struct {
 
 	cfg      *Config
 	engineid int64
+	pending  []byte /// read from the south before the engine started, goes through the rules first
+
+	key       string /// who and where the session is from, for the audit log
+	client    string
+	started   time.Time
+	session   *rules.Session
+	bytesup   int64
+	bytesdown int64
+	finished  int32
 }
 
 func NewEngine(north relay.Relay, south relay.Relay, cfg *Config, rulesproc *rules.Processor) *Engine {
@@ -37,6 +55,7 @@ func NewEngine(north relay.Relay, south relay.Relay, cfg *Config, rulesproc *rul
 		cfg:       cfg,
 		engineid:  atomic.AddInt64(&engineid, 1),
 		rulesproc: rulesproc,
+		started:   time.Now(),
 	}
 	if cfg.Logdebug {
 		e.logdebug.EnableDebugLogs(true, fmt.Sprint("e-", e.engineid))
@@ -44,7 +63,42 @@ func NewEngine(north relay.Relay, south relay.Relay, cfg *Config, rulesproc *rul
 	return e
 }
 
+// / Data already read from the south, to be processed before anything else
+func (p *Engine) SetPending(data []byte) {
+	p.pending = data
+}
+
+// / Who the session belongs to - the (masked) proxy key and the client address - for the audit log
+func (p *Engine) SetClient(key string, client string) {
+	p.key, p.client = key, client
+}
+
+// / Called as each direction stops - once both have, the session is over
+func (p *Engine) finish() {
+	if atomic.AddInt32(&p.finished, 1) != 2 {
+		return
+	}
+	audit := p.rulesproc.Audit()
+	if audit == nil {
+		return
+	}
+	record := &rules.AuditRecord{
+		Event:     "session",
+		Session:   fmt.Sprint("e-", p.engineid),
+		Key:       p.key,
+		Client:    p.client,
+		BytesUp:   atomic.LoadInt64(&p.bytesup),
+		BytesDown: atomic.LoadInt64(&p.bytesdown),
+		Duration:  time.Since(p.started).Round(time.Millisecond).String(),
+	}
+	if p.session != nil {
+		record.Destination = p.session.Target()
+	}
+	audit.Write(record)
+}
+
 func (p *Engine) ProcessNorthbound() {
+	defer p.finish()
 	defer util.OnPanicFunc()
 	defer p.north.Close()
 	defer p.south.Close()
@@ -53,29 +107,66 @@ func (p *Engine) ProcessNorthbound() {
 		p.logdebug.LogDebug("Northbound logging enabled", "n")
 	}
 
+	session := p.rulesproc.NewSession()
+	p.session = session
+	if audit := p.rulesproc.Audit(); audit != nil {
+		session.OnDecision = func(req *rules.Request, verdict rules.Verdict) {
+			audit.Write(&rules.AuditRecord{
+				Event:       "request",
+				Session:     fmt.Sprint("e-", p.engineid),
+				Key:         p.key,
+				Client:      p.client,
+				Destination: req.Target,
+				Method:      req.Method,
+				Rule:        verdict.Rule,
+				Action:      string(verdict.Response),
+				WouldBlock:  string(verdict.WouldBlock),
+			})
+		}
+	}
+	router, _ := p.north.(Router)
+	routed := router == nil
 	for {
-		p.logdebug.LogDebug("Waiting for message from south", "n")
-		message, err := p.south.RecvMsg()
-		util.CheckError(err)
-		rule := p.rulesproc.Allow(message)
-		if rule == rules.ALLOW {
-			p.logdebug.LogData(string(message), "n")
-			p.north.SendMsg(message)
-		} else {
-			p.logdebug.LogDebug(fmt.Sprint("Rule blocked message. ", string(message)), "n")
-			if rule == rules.DROPFLAT {
-				p.logdebug.LogDebug("Dropping message without response and closing the connection", "n")
+		message := p.pending
+		p.pending = nil
+		if len(message) == 0 {
+			p.logdebug.LogDebug("Waiting for message from south", "n")
+			var err error
+			message, err = p.south.RecvMsg()
+			util.CheckError(err)
+		}
+		allowed, verdict := session.Process(message)
+		if len(allowed) > 0 && !routed {
+			if err := router.Route(session.Target()); err != nil {
+				log.Println(fmt.Sprint("e-", p.engineid), "no upstream for", session.Target(), err)
+				if session.Target() != "" {
+					p.south.SendMsg(badGateway)
+				}
 				break
+			}
+			routed = true
+		}
+		if len(allowed) > 0 {
+			p.logdebug.LogData(string(allowed), "n")
+			p.north.SendMsg(allowed)
+			atomic.AddInt64(&p.bytesup, int64(len(allowed)))
+		}
+		if verdict.Response != rules.ALLOW {
+			log.Println(fmt.Sprint("e-", p.engineid), "blocked by rule", verdict)
+			p.logdebug.LogDebug(fmt.Sprint("Rule blocked message. ", string(message)), "n")
+			if verdict.Response == rules.REPSONDFAIL && verdict.Reply != nil {
+				p.logdebug.LogDebug("Responding to the client and closing the connection", "n")
+				p.south.SendMsg(verdict.Reply.Bytes())
 			} else {
-				p.logdebug.LogDebug("Responding with 403 and closing the connection", "n")
-				p.north.SendMsg([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
-				break
+				p.logdebug.LogDebug("Dropping message without response and closing the connection", "n")
 			}
+			break
 		}
 	}
 }
 
 func (p *Engine) ProcessSouthbound() {
+	defer p.finish()
 	defer util.OnPanicFunc()
 	defer p.north.Close()
 	defer p.south.Close()
@@ -91,5 +182,6 @@ func (p *Engine) ProcessSouthbound() {
 		p.logdebug.LogData(string(buffer), "s")
 		err = p.south.SendMsg(buffer)
 		util.CheckError(err)
+		atomic.AddInt64(&p.bytesdown, int64(len(buffer)))
 	}
 }
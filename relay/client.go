@@ -24,8 +24,13 @@ type Client struct {
 	southbuffer   []byte
 	trustedcacert []string
 
+	deadline time.Time /// while setting up a tunnel - nothing waits past this, see SetConnectDeadline
+
 	paramname  string
 	paramvalue string
+	handshake  map[string]string /// extra params sent with the tunnel request
+	respheader http.Header       /// headers of the remote's reply to the tunnel request
+	pending    []byte            /// read past the end of the tunnel reply, returned by the next RecvMsg
 
 	debuglogs DebugLog
 	connid    string
@@ -83,20 +88,52 @@ func (p *Client) EnableDebugLogs(on bool, connid string) {
 	p.connid = connid
 }
 
-func (p *Client) checkFirstResp(conn net.Conn) (valid bool, status string) {
+func (p *Client) SetHandshakeParam(name string, value string) {
+	if p.handshake == nil {
+		p.handshake = make(map[string]string)
+	}
+	p.handshake[name] = value
+}
+
+func (p *Client) HandshakeHeader(name string) string {
+	return p.respheader.Get(name)
+}
+
+func (p *Client) SetConnectDeadline(deadline time.Time) {
+	p.deadline = deadline
+}
+
+// / When a read or write started now should give up - after the timeout, or sooner at the connect deadline
+func (p *Client) waitUntil() time.Time {
+	until := time.Now().Add(p.timeout)
+	if !p.deadline.IsZero() && p.deadline.Before(until) {
+		return p.deadline
+	}
+	return until
+}
+
+func (p *Client) checkFirstResp(conn net.Conn) error {
 	/// Read the 1st response from the north - then, if it's a http 200, we can start the tunnel
 	///DEBUG - read the raw data - see what we get
 	//buf := make([]byte, 1024)
 	//n, err := conn.Read(buf)
 	//fmt.Println("Raw HTTP response ", string(buf[:n]))
 	//util.CheckError(err)
-	firstresp, err := http.ReadResponse(bufio.NewReader(conn), nil) /// this is a
-	util.CheckError(err)
+	conn.SetReadDeadline(p.waitUntil())
+	reader := bufio.NewReader(conn)
+	firstresp, err := http.ReadResponse(reader, nil) /// this is a
+	if err != nil {
+		return err
+	}
+	p.respheader = firstresp.Header
+	if reader.Buffered() > 0 {
+		p.pending, _ = reader.Peek(reader.Buffered())
+	}
 	if firstresp.StatusCode != 200 {
 		fmt.Println("Error response from the north", firstresp.Status)
-		return false, firstresp.Status
+		return fmt.Errorf("%w: %s", ErrTunnelRejected, firstresp.Status)
 	}
-	return true, ""
+	return nil
 }
 
 /*
@@ -107,15 +144,15 @@ func (p *Client) Hijack() net.Conn {
 	return p.conn
 }
 
-func (p *Client) connectTls() (conn net.Conn, err error) {
-	config := &tls.Config{}
+// / The system cert pool plus any extra trusted ca cert files
+func rootCAPool(trustedcacert []string, debuglogs *DebugLog) *x509.CertPool {
 	// Get the SystemCertPool, continue with an empty pool on error
 	rootCAs, _ := x509.SystemCertPool()
 	if rootCAs == nil {
 		rootCAs = x509.NewCertPool()
 	}
-	for _, certfile := range p.trustedcacert {
-		p.debuglogs.LogDebug("Adding trusted certfile ", certfile)
+	for _, certfile := range trustedcacert {
+		debuglogs.LogDebug("Adding trusted certfile ", certfile)
 
 		// Read in the certfile file
 		certs, err := os.ReadFile(certfile)
@@ -125,12 +162,17 @@ func (p *Client) connectTls() (conn net.Conn, err error) {
 			log.Println("No certs appended, using system certs only")
 		}
 	}
-	config.RootCAs = rootCAs
+	return rootCAs
+}
+
+func (p *Client) connectTls() (conn net.Conn, err error) {
+	config := &tls.Config{}
+	config.RootCAs = rootCAPool(p.trustedcacert, &p.debuglogs)
 
 	fullurl, err := url.Parse(p.url)
 	util.CheckError(err)
 	p.debuglogs.LogDebug("Fullurl ", fullurl.Hostname())
-	conn, err = tls.Dial("tcp", fullurl.Hostname()+":"+fullurl.Port(), config)
+	conn, err = tls.DialWithDialer(&net.Dialer{Timeout: p.timeout, Deadline: p.deadline}, "tcp", fullurl.Hostname()+":"+fullurl.Port(), config)
 	if err != nil {
 		return nil, err
 	}
@@ -140,7 +182,8 @@ func (p *Client) connectTls() (conn net.Conn, err error) {
 func (p *Client) connectRawTcp() (conn net.Conn, err error) {
 	fullurl, err := url.Parse(p.url)
 	util.CheckError(err)
-	return net.Dial("tcp", fullurl.Hostname()+":"+fullurl.Port())
+	dialer := &net.Dialer{Timeout: p.timeout, Deadline: p.deadline}
+	return dialer.Dial("tcp", fullurl.Hostname()+":"+fullurl.Port())
 }
 
 func (p *Client) Connect() error {
@@ -157,17 +200,26 @@ func (p *Client) Connect() error {
 
 	p.conn = conn
 	if p.paramname != "" {
-		data, err := json.Marshal(map[string]string{p.paramname: p.paramvalue})
+		params := map[string]string{p.paramname: p.paramvalue}
+		for name, value := range p.handshake {
+			params[name] = value
+		}
+		data, err := json.Marshal(params)
 		util.CheckError(err)
 		buf := &bytes.Buffer{}
 		buf.Write(data)
 		req, err := http.NewRequest(http.MethodPost, p.url, buf)
+		util.CheckError(err)
 		/// This should trigger the tunnel setup - after that we should be on a tls/tcp protocol
+		p.conn.SetWriteDeadline(p.waitUntil())
 		err = req.Write(p.conn)
-		util.CheckError(err)
-		if valid, status := p.checkFirstResp(p.conn); !valid {
-
-			return fmt.Errorf(status)
+		if err != nil {
+			p.conn.Close()
+			return err
+		}
+		if err = p.checkFirstResp(p.conn); err != nil {
+			p.conn.Close()
+			return err
 		}
 	}
 	return nil
@@ -179,7 +231,7 @@ func (p *Client) Close() {
 
 func (p *Client) SendMsg(data []byte) error {
 	p.debuglogs.LogData(string(data), "send: ")
-	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	p.conn.SetWriteDeadline(p.waitUntil())
 	_, err := p.conn.Write(data)
 	//// FOR DEBUGGING TLS ISSUE
 	util.CheckError(err)
@@ -187,7 +239,12 @@ func (p *Client) SendMsg(data []byte) error {
 }
 
 func (p *Client) RecvMsg() (data []byte, err error) {
-	p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	if len(p.pending) > 0 {
+		data, p.pending = p.pending, nil
+		p.debuglogs.LogData(string(data), "recv: ")
+		return data, nil
+	}
+	p.conn.SetReadDeadline(p.waitUntil())
 	data = p.southbuffer
 	n, err := p.conn.Read(data)
 	//// FOR DEBUGGING TLS ISSUE
@@ -0,0 +1,277 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	POLLTRANSPORT = "poll" /// value of the "transport" param when opening a long polling session
+	POLLSESSION   = "sid"
+	POLLSEQ       = "seq"
+	POLLACK       = "ack"
+	POLLWAIT      = "wait"
+	POLLSEQHEADER = "X-Seq"
+)
+
+// / Long polling relay - for networks that only pass complete, short lived http request/response pairs.
+// / Upstream data is sent in POST bodies, downstream data is collected by held open GETs. Every chunk carries
+// / a sequence number so either side can retransmit after a failed request without losing or duplicating data.
+type HttpPollRelay struct {
+	url     string
+	timeout time.Duration
+	client  *http.Client
+
+	trustedcacert []string
+
+	paramname  string
+	paramvalue string
+	handshake  map[string]string
+	respheader http.Header
+
+	deadline      time.Time       /// while connecting - requests give up here, see SetConnectDeadline
+	connectctx    context.Context /// carries the deadline, nil when there isn't one
+	cancelconnect context.CancelFunc
+
+	session string
+	sendseq uint64 /// next upstream chunk to send
+	recvseq uint64 /// next downstream chunk we expect
+
+	debuglogs DebugLog
+}
+
+func NewHttpPollRelay(url string, timeout time.Duration, paramname string, paramvalue string) *HttpPollRelay {
+	return &HttpPollRelay{
+		url:        pollUrl(url),
+		timeout:    timeout,
+		paramname:  paramname,
+		paramvalue: paramvalue,
+	}
+}
+
+// / The tunnel endpoints are written as tls:// or tcp:// urls - map them onto something an http client understands
+func pollUrl(rawurl string) string {
+	fullurl, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	switch fullurl.Scheme {
+	case "tls", "https":
+		fullurl.Scheme = "https"
+	case "tcp", "http":
+		fullurl.Scheme = "http"
+	}
+	return fullurl.String()
+}
+
+func (p *HttpPollRelay) AllowCert(cert []string) {
+	p.trustedcacert = cert
+}
+
+func (p *HttpPollRelay) SetHandshakeParam(name string, value string) {
+	if p.handshake == nil {
+		p.handshake = make(map[string]string)
+	}
+	p.handshake[name] = value
+}
+
+func (p *HttpPollRelay) HandshakeHeader(name string) string {
+	return p.respheader.Get(name)
+}
+
+func (p *HttpPollRelay) SetConnectDeadline(deadline time.Time) {
+	if p.cancelconnect != nil {
+		p.cancelconnect()
+	}
+	p.deadline, p.connectctx, p.cancelconnect = deadline, nil, nil
+	if !deadline.IsZero() {
+		p.connectctx, p.cancelconnect = context.WithDeadline(context.Background(), deadline)
+	}
+}
+
+func (p *HttpPollRelay) context() context.Context {
+	if p.connectctx != nil {
+		return p.connectctx
+	}
+	return context.Background()
+}
+
+func (p *HttpPollRelay) post(url string, contenttype string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(p.context(), http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contenttype)
+	return p.client.Do(req)
+}
+
+func (p *HttpPollRelay) get(url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(p.context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return p.client.Do(req)
+}
+
+func (p *HttpPollRelay) EnableDebugLogs(on bool, connid string) {
+	p.debuglogs.EnableDebugLogs(on, connid)
+}
+
+func (p *HttpPollRelay) Connect() error {
+	p.client = &http.Client{
+		Timeout: p.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAPool(p.trustedcacert, &p.debuglogs)},
+		},
+	}
+	params := map[string]string{p.paramname: p.paramvalue, "transport": POLLTRANSPORT}
+	for name, value := range p.handshake {
+		params[name] = value
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := p.post(p.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	p.respheader = resp.Header
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", ErrTunnelRejected, resp.Status)
+	}
+	p.session = strings.TrimSpace(string(body))
+	if p.session == "" {
+		return fmt.Errorf("%w: no session id", ErrTunnelRejected)
+	}
+	p.debuglogs.LogDebug("Poll session "+p.session, "poll")
+	return nil
+}
+
+func (p *HttpPollRelay) sessionUrl(params map[string]string) string {
+	query := url.Values{}
+	query.Set(POLLSESSION, p.session)
+	for key, val := range params {
+		query.Set(key, val)
+	}
+	return p.url + "?" + query.Encode()
+}
+
+func (p *HttpPollRelay) Close() {
+	if p.session == "" {
+		return
+	}
+	req, err := http.NewRequest(http.MethodDelete, p.sessionUrl(nil), nil)
+	if err != nil {
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// / Retry a request until it gets a definite answer or we run out of time
+func (p *HttpPollRelay) retry(do func() (done bool, err error)) error {
+	deadline := time.Now().Add(p.timeout)
+	if !p.deadline.IsZero() && p.deadline.Before(deadline) {
+		deadline = p.deadline
+	}
+	backoff := 100 * time.Millisecond
+	for {
+		done, err := do()
+		if done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("poll request failed after retrying: %v", err)
+		}
+		p.debuglogs.LogDebug(fmt.Sprint("Retrying poll request ", err), "poll")
+		time.Sleep(backoff)
+		if backoff < 2*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (p *HttpPollRelay) SendMsg(data []byte) error {
+	p.debuglogs.LogData(string(data), "send: ")
+	sendurl := p.sessionUrl(map[string]string{POLLSEQ: strconv.FormatUint(p.sendseq, 10)})
+	err := p.retry(func() (bool, error) {
+		resp, err := p.post(sendurl, "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			return false, err
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			return true, nil
+		case resp.StatusCode >= 500:
+			return false, errors.New(resp.Status)
+		default:
+			return true, fmt.Errorf("poll send rejected: %s", resp.Status)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	p.sendseq++
+	return nil
+}
+
+func (p *HttpPollRelay) RecvMsg() (data []byte, err error) {
+	for {
+		var status int
+		recvurl := p.sessionUrl(map[string]string{
+			POLLACK:  strconv.FormatUint(p.recvseq, 10),
+			POLLWAIT: strconv.Itoa(int(p.timeout / 2 / time.Second)),
+		})
+		err = p.retry(func() (bool, error) {
+			resp, err := p.get(recvurl)
+			if err != nil {
+				return false, err
+			}
+			defer resp.Body.Close()
+			status = resp.StatusCode
+			switch {
+			case status == http.StatusOK:
+				if seq := resp.Header.Get(POLLSEQHEADER); seq != strconv.FormatUint(p.recvseq, 10) {
+					return true, fmt.Errorf("poll recv out of sequence: got %s, expected %d", seq, p.recvseq)
+				}
+				data, err = io.ReadAll(resp.Body)
+				return err == nil, err /// a short body is retransmitted on the next attempt
+			case status == http.StatusNoContent:
+				return true, nil
+			case status == http.StatusNotFound || status == http.StatusGone:
+				return true, io.EOF
+			case status >= 500:
+				return false, errors.New(resp.Status)
+			default:
+				return true, fmt.Errorf("poll recv rejected: %s", resp.Status)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusOK {
+			p.recvseq++
+			p.debuglogs.LogData(string(data), "recv: ")
+			return data, nil
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const maxPendingChunks = 64 /// downstream chunks not yet acked by the client before SendMsg blocks
+
+// / The remote end of a HttpPollRelay. The http handlers feed it with the client's requests, the engine sees
+// / it as an ordinary south side relay.
+type PollSession struct {
+	id      string
+	timeout time.Duration
+
+	lock     sync.Mutex
+	changed  *sync.Cond
+	upseq    uint64 /// next upstream chunk we expect from the client
+	upstream chan []byte
+	downseq  uint64   /// sequence number of downstream[0]
+	pending  [][]byte /// downstream chunks, kept until the client acks them
+	closed   bool
+
+	onclose   func(id string)
+	debuglogs DebugLog
+}
+
+func NewPollSession(timeout time.Duration, onclose func(id string)) *PollSession {
+	idbytes := make([]byte, 16)
+	_, err := rand.Read(idbytes)
+	if err != nil {
+		panic(err)
+	}
+	p := &PollSession{
+		id:       hex.EncodeToString(idbytes),
+		timeout:  timeout,
+		upstream: make(chan []byte, maxPendingChunks),
+		onclose:  onclose,
+	}
+	p.changed = sync.NewCond(&p.lock)
+	return p
+}
+
+func (p *PollSession) Id() string {
+	return p.id
+}
+
+func (p *PollSession) EnableDebugLogs(on bool, connid string) {
+	p.debuglogs.EnableDebugLogs(on, connid)
+}
+
+// / Nothing to do - the session is created by the client's first request
+func (p *PollSession) Connect() error {
+	return nil
+}
+
+func (p *PollSession) Close() {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.upstream)
+	p.changed.Broadcast()
+	p.lock.Unlock()
+	if p.onclose != nil {
+		p.onclose(p.id)
+	}
+}
+
+func (p *PollSession) SendMsg(data []byte) error {
+	chunk := make([]byte, len(data)) /// the engine reuses its buffers
+	copy(chunk, data)
+	deadline := time.AfterFunc(p.timeout, func() {
+		p.lock.Lock()
+		p.changed.Broadcast()
+		p.lock.Unlock()
+	})
+	defer deadline.Stop()
+	start := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for len(p.pending) >= maxPendingChunks && !p.closed {
+		if time.Since(start) >= p.timeout {
+			return errors.New("poll session: client stopped collecting data")
+		}
+		p.changed.Wait()
+	}
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+	p.debuglogs.LogData(string(chunk), "send: ")
+	p.pending = append(p.pending, chunk)
+	p.changed.Broadcast()
+	return nil
+}
+
+func (p *PollSession) RecvMsg() (data []byte, err error) {
+	select {
+	case data, ok := <-p.upstream:
+		if !ok {
+			return nil, io.EOF
+		}
+		p.debuglogs.LogData(string(data), "recv: ")
+		return data, nil
+	case <-time.After(p.timeout):
+		return nil, errors.New("poll session: timed out waiting for the client")
+	}
+}
+
+// / Upstream chunk posted by the client. Replies with the http status to return.
+func (p *PollSession) Upload(seq uint64, data []byte) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch {
+	case p.closed:
+		return http.StatusGone
+	case seq < p.upseq:
+		return http.StatusOK /// a retransmit of something we already have - the client missed our ack
+	case seq > p.upseq:
+		return http.StatusConflict /// the client only sends the next chunk once the previous one was acked
+	}
+	select {
+	case p.upstream <- data:
+		p.upseq++
+		return http.StatusOK
+	default:
+		return http.StatusServiceUnavailable /// the engine is behind, the client will retry
+	}
+}
+
+// / Held open GET from the client. Everything before ack has been received, so drop it, then wait up to
+// / hold for the chunk numbered ack. Returns the chunk and an http status.
+func (p *PollSession) Download(ack uint64, hold time.Duration) ([]byte, int) {
+	timer := time.AfterFunc(hold, func() {
+		p.lock.Lock()
+		p.changed.Broadcast()
+		p.lock.Unlock()
+	})
+	defer timer.Stop()
+	start := time.Now()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if ack < p.downseq || ack > p.downseq+uint64(len(p.pending)) {
+		return nil, http.StatusConflict
+	}
+	acked := int(ack - p.downseq)
+	p.pending = p.pending[acked:]
+	p.downseq = ack
+	if acked > 0 {
+		p.changed.Broadcast()
+	}
+	for len(p.pending) == 0 && !p.closed && time.Since(start) < hold {
+		p.changed.Wait()
+	}
+	if len(p.pending) > 0 {
+		return p.pending[0], http.StatusOK
+	}
+	if p.closed {
+		return nil, http.StatusGone
+	}
+	return nil, http.StatusNoContent
+}
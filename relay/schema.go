@@ -1,5 +1,13 @@
 package relay
 
+import (
+	"errors"
+	"time"
+)
+
+// / The remote hdnprxy answered the tunnel request, but said no - a bad key, or a layer it won't provide
+var ErrTunnelRejected = errors.New("tunnel rejected by the remote")
+
 type Relay interface {
 	Connect() error
 	Close()
@@ -7,3 +15,16 @@ type Relay interface {
 	RecvMsg() (data []byte, err error)
 	EnableDebugLogs(bool, string)
 }
+
+// / Tunnel clients that open with a handshake request to the remote hdnprxy. Extra params go out with the
+// / request, the remote answers with headers on its reply.
+type Handshaker interface {
+	SetHandshakeParam(name string, value string)
+	HandshakeHeader(name string) string
+}
+
+// / Tunnel clients whose setup can be held to a deadline - dialling, the handshake and anything a layer
+// / wrapped around them sends while connecting give up there. The zero time clears it once connected.
+type ConnectDeadliner interface {
+	SetConnectDeadline(deadline time.Time)
+}
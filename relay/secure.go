@@ -0,0 +1,296 @@
+package relay
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	E2EPARAM  = "e2e"           /// handshake param asking for an inner encrypted channel
+	E2EHEADER = "X-Hdnprxy-E2e" /// set on the remote's reply when it has agreed
+
+	secureMagic    = "HDE1"
+	secureKeyLen   = 32
+	secureMacLen   = sha256.Size
+	maxSecureFrame = 16384
+)
+
+// / An encrypted channel inside the tunnel, so a tls terminating front (cdn, load balancer) only sees ciphertext.
+// / Both ends prove they know the shared E2e secret while exchanging ephemeral x25519 keys, then every frame is
+// / sealed with aes-gcm under a per direction key. Nonces are frame counters, so a replayed, dropped or reordered
+// / frame fails to open. The secret must never cross the front itself - not the proxy key, which is in the tunnel
+// / request.
+type SecureRelay struct {
+	inner     Relay
+	psk       []byte
+	initiator bool
+
+	handshake sync.Once
+	hserr     error
+
+	sendlock sync.Mutex
+	send     cipher.AEAD
+	sendseq  uint64
+	recv     cipher.AEAD
+	recvseq  uint64
+
+	recvbuf   []byte
+	debuglogs DebugLog
+}
+
+// / Wrap a tunnel client that hasn't connected yet, the key exchange runs as part of Connect
+func NewSecureRelay(inner Relay, psk string) *SecureRelay {
+	return &SecureRelay{
+		inner:     inner,
+		psk:       []byte(psk),
+		initiator: true,
+	}
+}
+
+// / Wrap the south side of an accepted tunnel. The key exchange runs on first use, so the caller can
+// / finish replying to the tunnel request first.
+func NewSecureRelayFromConn(inner Relay, psk string, pending []byte) *SecureRelay {
+	return &SecureRelay{
+		inner:   inner,
+		psk:     []byte(psk),
+		recvbuf: append([]byte{}, pending...),
+	}
+}
+
+func (p *SecureRelay) SetConnectDeadline(deadline time.Time) {
+	if deadliner, ok := p.inner.(ConnectDeadliner); ok {
+		deadliner.SetConnectDeadline(deadline)
+	}
+}
+
+func (p *SecureRelay) SetHandshakeParam(name string, value string) {
+	if handshaker, ok := p.inner.(Handshaker); ok {
+		handshaker.SetHandshakeParam(name, value)
+	}
+}
+
+func (p *SecureRelay) HandshakeHeader(name string) string {
+	if handshaker, ok := p.inner.(Handshaker); ok {
+		return handshaker.HandshakeHeader(name)
+	}
+	return ""
+}
+
+func (p *SecureRelay) EnableDebugLogs(on bool, connid string) {
+	p.debuglogs.EnableDebugLogs(on, connid)
+	p.inner.EnableDebugLogs(on, connid)
+}
+
+func (p *SecureRelay) Connect() error {
+	handshaker, ok := p.inner.(Handshaker)
+	if !ok {
+		return errors.New("e2e: the relay has no tunnel handshake")
+	}
+	handshaker.SetHandshakeParam(E2EPARAM, "1")
+	err := p.inner.Connect()
+	if err != nil {
+		return err
+	}
+	if handshaker.HandshakeHeader(E2EHEADER) == "" {
+		p.inner.Close()
+		return fmt.Errorf("%w: the remote did not agree to encrypt the tunnel", ErrTunnelRejected)
+	}
+	err = p.keyExchange()
+	if err != nil {
+		p.inner.Close()
+	}
+	return err
+}
+
+func (p *SecureRelay) Close() {
+	p.inner.Close()
+}
+
+func (p *SecureRelay) mac(label string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, p.psk)
+	mac.Write([]byte(label))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// / hkdf (rfc 5869) with sha256 - extract with the tunnel secret as salt, then expand one key
+func (p *SecureRelay) deriveKey(shared []byte, info string) []byte {
+	extract := hmac.New(sha256.New, p.psk)
+	extract.Write(shared)
+	prk := extract.Sum(nil)
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(info))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:secureKeyLen]
+}
+
+func (p *SecureRelay) readFull(n int) ([]byte, error) {
+	for len(p.recvbuf) < n {
+		chunk, err := p.inner.RecvMsg()
+		if err != nil {
+			return nil, err
+		}
+		p.recvbuf = append(p.recvbuf, chunk...)
+	}
+	data := make([]byte, n)
+	copy(data, p.recvbuf)
+	p.recvbuf = p.recvbuf[n:]
+	return data, nil
+}
+
+func (p *SecureRelay) keyExchange() error {
+	p.handshake.Do(func() {
+		p.hserr = p.doKeyExchange()
+		if p.hserr != nil {
+			p.debuglogs.LogDebug(p.hserr.Error(), "e2e")
+		}
+	})
+	return p.hserr
+}
+
+func (p *SecureRelay) doKeyExchange() error {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	ours := ephemeral.PublicKey().Bytes()
+	var initpub, resppub []byte
+
+	if p.initiator {
+		initpub = ours
+		hello := append([]byte(secureMagic), initpub...)
+		err = p.inner.SendMsg(append(hello, p.mac("init", initpub)...))
+		if err != nil {
+			return err
+		}
+		reply, err := p.readFull(secureKeyLen + secureMacLen)
+		if err != nil {
+			return err
+		}
+		resppub = reply[:secureKeyLen]
+		if !hmac.Equal(reply[secureKeyLen:], p.mac("resp", initpub, resppub)) {
+			return fmt.Errorf("%w: the remote does not know the tunnel secret", ErrTunnelRejected)
+		}
+	} else {
+		hello, err := p.readFull(len(secureMagic) + secureKeyLen + secureMacLen)
+		if err != nil {
+			return err
+		}
+		if string(hello[:len(secureMagic)]) != secureMagic {
+			return errors.New("e2e: not a key exchange")
+		}
+		initpub = hello[len(secureMagic) : len(secureMagic)+secureKeyLen]
+		if !hmac.Equal(hello[len(secureMagic)+secureKeyLen:], p.mac("init", initpub)) {
+			return errors.New("e2e: the local side does not know the tunnel secret")
+		}
+		resppub = ours
+		err = p.inner.SendMsg(append(append([]byte{}, resppub...), p.mac("resp", initpub, resppub)...))
+		if err != nil {
+			return err
+		}
+	}
+
+	theirs := resppub
+	if !p.initiator {
+		theirs = initpub
+	}
+	peer, err := ecdh.X25519().NewPublicKey(theirs)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return err
+	}
+	transcript := string(initpub) + string(resppub)
+	toresp, err := newGcm(p.deriveKey(shared, "hdnprxy i2r "+transcript))
+	if err != nil {
+		return err
+	}
+	toinit, err := newGcm(p.deriveKey(shared, "hdnprxy r2i "+transcript))
+	if err != nil {
+		return err
+	}
+	if p.initiator {
+		p.send, p.recv = toresp, toinit
+	} else {
+		p.send, p.recv = toinit, toresp
+	}
+	p.debuglogs.LogDebug("Key exchange complete", "e2e")
+	return nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (p *SecureRelay) SendMsg(data []byte) error {
+	err := p.keyExchange()
+	if err != nil {
+		return err
+	}
+	p.sendlock.Lock()
+	defer p.sendlock.Unlock()
+	for len(data) > 0 {
+		plain := data
+		if len(plain) > maxSecureFrame {
+			plain = plain[:maxSecureFrame]
+		}
+		data = data[len(plain):]
+		frame := make([]byte, 4, 4+len(plain)+p.send.Overhead())
+		frame = p.send.Seal(frame, nonce(p.send, p.sendseq), plain, nil)
+		binary.BigEndian.PutUint32(frame[:4], uint32(len(frame)-4))
+		p.sendseq++
+		err = p.inner.SendMsg(frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SecureRelay) RecvMsg() (data []byte, err error) {
+	err = p.keyExchange()
+	if err != nil {
+		return nil, err
+	}
+	header, err := p.readFull(4)
+	if err != nil {
+		return nil, err
+	}
+	framelen := int(binary.BigEndian.Uint32(header))
+	if framelen > maxSecureFrame+p.recv.Overhead() {
+		return nil, errors.New("e2e: frame too large")
+	}
+	frame, err := p.readFull(framelen)
+	if err != nil {
+		return nil, err
+	}
+	data, err = p.recv.Open(frame[:0], nonce(p.recv, p.recvseq), frame, nil)
+	if err != nil {
+		return nil, errors.New("e2e: frame failed to authenticate")
+	}
+	p.recvseq++
+	return data, nil
+}
@@ -0,0 +1,258 @@
+package relay
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	SHAPEPARAM  = "shape"           /// handshake param carrying the ShapingConfig as json
+	SHAPEHEADER = "X-Hdnprxy-Shape" /// set on the remote's reply when it has agreed to shape
+
+	shapeData  = 1
+	shapeCover = 2
+
+	shapeHeaderLen = 5 /// type, record length, payload length
+	maxShapeRecord = 65535
+)
+
+// / Both ends pad records to the same buckets and may add delays and cover traffic. The local side
+// / picks the settings and sends them to the remote during the tunnel handshake.
+type ShapingConfig struct {
+	Buckets   []int  /// record sizes to pad up to, e.g. [512, 1460, 4096, 16384]
+	MaxDelay  string /// random delay of up to this long before each record
+	CoverIdle string /// send a cover record if nothing has been sent for this long, "" for none
+}
+
+func (c *ShapingConfig) Validate() error {
+	if len(c.Buckets) == 0 {
+		return errors.New("shaping: no buckets")
+	}
+	for _, bucket := range c.Buckets {
+		if bucket <= shapeHeaderLen || bucket > maxShapeRecord {
+			return fmt.Errorf("shaping: bucket %d out of range", bucket)
+		}
+	}
+	if c.MaxDelay != "" {
+		delay, err := time.ParseDuration(c.MaxDelay)
+		if err != nil || delay < 0 || delay > time.Second {
+			return fmt.Errorf("shaping: invalid MaxDelay %s", c.MaxDelay)
+		}
+	}
+	if c.CoverIdle != "" {
+		idle, err := time.ParseDuration(c.CoverIdle)
+		if err != nil || idle < 100*time.Millisecond {
+			return fmt.Errorf("shaping: invalid CoverIdle %s", c.CoverIdle)
+		}
+	}
+	return nil
+}
+
+// / Frames everything sent over the inner relay into padded records so sizes and timing no longer
+// / mirror the tunneled tls records.
+type ShapedRelay struct {
+	inner     Relay
+	cfg       ShapingConfig
+	buckets   []int
+	maxdelay  time.Duration
+	coveridle time.Duration
+
+	sendlock sync.Mutex
+	lastsend time.Time
+
+	recvbuf []byte
+	done    chan struct{}
+	once    sync.Once
+
+	debuglogs DebugLog
+}
+
+func newShapedRelay(inner Relay, cfg *ShapingConfig) *ShapedRelay {
+	p := &ShapedRelay{
+		inner:   inner,
+		cfg:     *cfg,
+		buckets: append([]int{}, cfg.Buckets...),
+		done:    make(chan struct{}),
+	}
+	sort.Ints(p.buckets)
+	p.maxdelay, _ = time.ParseDuration(cfg.MaxDelay)
+	p.coveridle, _ = time.ParseDuration(cfg.CoverIdle)
+	return p
+}
+
+// / Wrap a tunnel client that hasn't connected yet - the shaping settings are sent with its handshake
+func NewShapedRelay(inner Relay, cfg *ShapingConfig) *ShapedRelay {
+	return newShapedRelay(inner, cfg)
+}
+
+// / Wrap the south side of an accepted tunnel, pending is anything already read past the handshake
+func NewShapedRelayFromConn(inner Relay, cfg *ShapingConfig, pending []byte) *ShapedRelay {
+	p := newShapedRelay(inner, cfg)
+	p.recvbuf = append(p.recvbuf, pending...)
+	p.start()
+	return p
+}
+
+func (p *ShapedRelay) SetConnectDeadline(deadline time.Time) {
+	if deadliner, ok := p.inner.(ConnectDeadliner); ok {
+		deadliner.SetConnectDeadline(deadline)
+	}
+}
+
+func (p *ShapedRelay) SetHandshakeParam(name string, value string) {
+	if handshaker, ok := p.inner.(Handshaker); ok {
+		handshaker.SetHandshakeParam(name, value)
+	}
+}
+
+func (p *ShapedRelay) HandshakeHeader(name string) string {
+	if handshaker, ok := p.inner.(Handshaker); ok {
+		return handshaker.HandshakeHeader(name)
+	}
+	return ""
+}
+
+func (p *ShapedRelay) EnableDebugLogs(on bool, connid string) {
+	p.debuglogs.EnableDebugLogs(on, connid)
+	p.inner.EnableDebugLogs(on, connid)
+}
+
+func (p *ShapedRelay) Connect() error {
+	handshaker, ok := p.inner.(Handshaker)
+	if !ok {
+		return errors.New("shaping: the relay has no tunnel handshake")
+	}
+	cfg, err := json.Marshal(p.cfg)
+	if err != nil {
+		return err
+	}
+	handshaker.SetHandshakeParam(SHAPEPARAM, string(cfg))
+	err = p.inner.Connect()
+	if err != nil {
+		return err
+	}
+	if handshaker.HandshakeHeader(SHAPEHEADER) == "" {
+		p.inner.Close()
+		return fmt.Errorf("%w: the remote did not agree to shape the tunnel", ErrTunnelRejected)
+	}
+	p.start()
+	return nil
+}
+
+func (p *ShapedRelay) start() {
+	p.lastsend = time.Now()
+	if p.coveridle > 0 {
+		go p.sendCover()
+	}
+}
+
+func (p *ShapedRelay) Close() {
+	p.once.Do(func() { close(p.done) })
+	p.inner.Close()
+}
+
+func (p *ShapedRelay) bucketFor(size int) int {
+	for _, bucket := range p.buckets {
+		if bucket >= size {
+			return bucket
+		}
+	}
+	return p.buckets[len(p.buckets)-1]
+}
+
+func (p *ShapedRelay) record(rectype byte, payload []byte, size int) []byte {
+	record := make([]byte, size)
+	record[0] = rectype
+	binary.BigEndian.PutUint16(record[1:3], uint16(size))
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(payload)))
+	copy(record[shapeHeaderLen:], payload)
+	return record
+}
+
+func (p *ShapedRelay) delay() {
+	if p.maxdelay > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(p.maxdelay))))
+	}
+}
+
+func (p *ShapedRelay) SendMsg(data []byte) error {
+	p.sendlock.Lock()
+	defer p.sendlock.Unlock()
+	maxpayload := p.buckets[len(p.buckets)-1] - shapeHeaderLen
+	for len(data) > 0 {
+		payload := data
+		if len(payload) > maxpayload {
+			payload = payload[:maxpayload]
+		}
+		data = data[len(payload):]
+		p.delay()
+		err := p.inner.SendMsg(p.record(shapeData, payload, p.bucketFor(len(payload)+shapeHeaderLen)))
+		if err != nil {
+			return err
+		}
+		p.lastsend = time.Now()
+	}
+	return nil
+}
+
+// / Fill idle periods with cover records of a random bucket size
+func (p *ShapedRelay) sendCover() {
+	defer func() {
+		recover() /// the inner relay panics on send once the connection has gone - that's our cue to stop
+	}()
+	for {
+		wait := p.coveridle/2 + time.Duration(rand.Int63n(int64(p.coveridle)))
+		select {
+		case <-p.done:
+			return
+		case <-time.After(wait):
+		}
+		if p.coverRecord() != nil {
+			return
+		}
+	}
+}
+
+func (p *ShapedRelay) coverRecord() error {
+	p.sendlock.Lock()
+	defer p.sendlock.Unlock()
+	if time.Since(p.lastsend) < p.coveridle {
+		return nil
+	}
+	p.debuglogs.LogDebug("Sending cover record", "shape")
+	p.lastsend = time.Now()
+	return p.inner.SendMsg(p.record(shapeCover, nil, p.buckets[rand.Intn(len(p.buckets))]))
+}
+
+func (p *ShapedRelay) RecvMsg() (data []byte, err error) {
+	for {
+		if len(p.recvbuf) >= shapeHeaderLen {
+			size := int(binary.BigEndian.Uint16(p.recvbuf[1:3]))
+			payloadlen := int(binary.BigEndian.Uint16(p.recvbuf[3:5]))
+			if size < shapeHeaderLen || payloadlen > size-shapeHeaderLen {
+				return nil, errors.New("shaping: corrupt record")
+			}
+			if len(p.recvbuf) >= size {
+				rectype := p.recvbuf[0]
+				payload := make([]byte, payloadlen)
+				copy(payload, p.recvbuf[shapeHeaderLen:])
+				p.recvbuf = p.recvbuf[size:]
+				if rectype == shapeData && payloadlen > 0 {
+					return payload, nil
+				}
+				continue
+			}
+		}
+		chunk, err := p.inner.RecvMsg()
+		if err != nil {
+			return nil, err
+		}
+		p.recvbuf = append(p.recvbuf, chunk...)
+	}
+}
@@ -0,0 +1,154 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// / Ranges a request must never reach - private, loopback, link local (including the cloud metadata
+// / address 169.254.169.254), carrier grade nat, multicast and reserved, for both ipv4 and ipv6
+var DefaultDenyCidrs = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+type SsrfConfig struct {
+	Enabled      bool
+	DenyCidrs    []string /// defaults to DefaultDenyCidrs
+	AllowCidrs   []string /// exceptions to DenyCidrs
+	KeepHostname bool     /// don't rewrite the request to the vetted address - only if the upstream proxy does its own checks
+}
+
+// / Resolves request destinations itself and refuses any that land in a denied range. Every address a
+// / name resolves to is checked, and the request is rewritten to the vetted address, so the upstream
+// / can't be steered somewhere else by a second lookup (dns rebinding).
+type AddressGuard struct {
+	deny         *CidrMatcher
+	allow        *CidrMatcher
+	keephostname bool
+
+	LookupIP func(ctx context.Context, network string, host string) ([]net.IP, error)
+	timeout  time.Duration
+}
+
+func NewAddressGuard(cfg *SsrfConfig) (*AddressGuard, error) {
+	denycidrs := cfg.DenyCidrs
+	if len(denycidrs) == 0 {
+		denycidrs = DefaultDenyCidrs
+	}
+	deny, err := NewCidrMatcher(denycidrs)
+	if err != nil {
+		return nil, err
+	}
+	allow, err := NewCidrMatcher(cfg.AllowCidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &AddressGuard{
+		deny:         deny,
+		allow:        allow,
+		keephostname: cfg.KeepHostname,
+		LookupIP:     net.DefaultResolver.LookupIP,
+		timeout:      10 * time.Second,
+	}, nil
+}
+
+func (g *AddressGuard) denied(ip net.IP) bool {
+	return g.deny.Match(ip) && !g.allow.Match(ip)
+}
+
+// / The address to connect to for host, or an error if it resolves anywhere it shouldn't
+func (g *AddressGuard) Vet(host string) (net.IP, error) {
+	addrs := []net.IP{net.ParseIP(host)}
+	if addrs[0] == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+		defer cancel()
+		var err error
+		addrs, err = g.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("%s has no addresses", host)
+		}
+	}
+	for _, addr := range addrs {
+		if g.denied(addr) {
+			return nil, fmt.Errorf("%s resolves to denied address %s", host, addr)
+		}
+	}
+	return addrs[0], nil
+}
+
+// / Check a request's destination - a CONNECT, an absolute-form url or the Host header - pinning it to the
+// / vetted address
+func (g *AddressGuard) Guard(req *Request) RuleResponse {
+	dest, err := ParseDestination(req.Target)
+	if err != nil {
+		fmt.Println("Blocked request without a usable destination ", req.Method, req.Target)
+		return REPSONDFAIL
+	}
+	ip, err := g.Vet(dest.Host)
+	if err != nil {
+		fmt.Println("Blocked", req.Method, req.Target, err)
+		return REPSONDFAIL
+	}
+	if g.keephostname || dest.IP != nil {
+		return ALLOW
+	}
+	pinned := net.JoinHostPort(ip.String(), strconv.Itoa(dest.Port))
+	if req.Method == "CONNECT" {
+		req.Head = []byte(strings.Replace(string(req.Head), req.Target, pinned, 1))
+	} else {
+		req.Head = pinHead(req.Head, ip)
+	}
+	req.Target = pinned
+	return ALLOW
+}
+
+// / The authority with its host swapped for ip, keeping the port if it had one
+func pinAuthority(authority string, ip net.IP) string {
+	if _, port, err := net.SplitHostPort(authority); err == nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// / Point a plain http request at ip. An absolute-form url (as sent to a proxy) has its authority
+// / swapped and keeps the Host header, so the origin still sees the name. Otherwise the Host header is
+// / the destination, so it is swapped instead.
+func pinHead(head []byte, ip net.IP) []byte {
+	lines := strings.SplitAfter(string(head), "\r\n")
+	method, rest, _ := strings.Cut(lines[0], " ")
+	uri, version, _ := strings.Cut(rest, " ")
+	if scheme := strings.Index(uri, "://"); scheme > 0 && !strings.HasPrefix(uri, "/") {
+		start := scheme + len("://")
+		end := strings.IndexAny(uri[start:], "/?#")
+		if end < 0 {
+			end = len(uri)
+		} else {
+			end += start
+		}
+		if at := strings.LastIndex(uri[start:end], "@"); at >= 0 {
+			start += at + 1 /// keep any userinfo
+		}
+		lines[0] = method + " " + uri[:start] + pinAuthority(uri[start:end], ip) + uri[end:] + " " + version
+		return []byte(strings.Join(lines, ""))
+	}
+	for i, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "host") {
+			lines[i+1] = name + ": " + pinAuthority(strings.TrimSpace(value), ip) + "\r\n"
+			break
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
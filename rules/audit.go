@@ -0,0 +1,128 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"hdnprxy/configs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditConfig struct {
+	File     string /// jsonl file to append to, e.g. "./logs/audit.jsonl"
+	MaxSize  int    /// rotate when the file reaches this many MB, defaults to 100
+	MaxFiles int    /// rotated files to keep - audit.jsonl.1 is the newest - defaults to 5
+}
+
+// / One line of the audit log. Event is "request" for each rule decision and "session" when a session
+// / ends, with the bytes transferred.
+type AuditRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Session     string    `json:"session"`
+	Key         string    `json:"key,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	WouldBlock  string    `json:"would_block,omitempty"` /// monitor mode - the action the rule would have taken
+	BytesUp     int64     `json:"bytes_up,omitempty"`
+	BytesDown   int64     `json:"bytes_down,omitempty"`
+	Duration    string    `json:"duration,omitempty"`
+}
+
+// / Appends audit records to a file, rotating it by size
+type AuditLog struct {
+	path     string
+	maxsize  int64
+	maxfiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+var (
+	auditlock sync.Mutex
+	auditlogs = make(map[string]*AuditLog)
+)
+
+// / Audit logs are shared by path, so a reloaded rule set keeps writing to the same file rather than
+// / opening it a second time
+func OpenAuditLog(cfg *AuditConfig) (*AuditLog, error) {
+	path := configs.Expand(cfg.File)
+	auditlock.Lock()
+	defer auditlock.Unlock()
+	a, ok := auditlogs[path]
+	if !ok {
+		a = &AuditLog{path: path}
+		if err := a.open(); err != nil {
+			return nil, err
+		}
+		auditlogs[path] = a
+	}
+	a.lock.Lock()
+	a.maxsize = int64(cfg.MaxSize) * 1024 * 1024
+	if a.maxsize <= 0 {
+		a.maxsize = 100 * 1024 * 1024
+	}
+	a.maxfiles = cfg.MaxFiles
+	if a.maxfiles <= 0 {
+		a.maxfiles = 5
+	}
+	a.lock.Unlock()
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	a.file.Close()
+	for i := a.maxfiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprint(a.path, ".", i), fmt.Sprint(a.path, ".", i+1))
+	}
+	os.Rename(a.path, a.path+".1")
+	return a.open()
+}
+
+func (a *AuditLog) Write(record *AuditRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Println("Unable to encode audit record", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxsize {
+		if err := a.rotate(); err != nil {
+			log.Println("Unable to rotate the audit log", a.path, err)
+			return
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Println("Unable to write the audit log", a.path, err)
+	}
+}
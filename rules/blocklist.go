@@ -0,0 +1,235 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"hdnprxy/configs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	FORMATHOSTS   = "hosts"   /// "0.0.0.0 tracker.example" - the usual hosts file block lists
+	FORMATPLAIN   = "plain"   /// one domain per line
+	FORMATADBLOCK = "adblock" /// "||tracker.example^", with "@@||" exceptions - other adblock rules are skipped
+)
+
+// / A domain list file in connect-rules.json. Every entry blocks the domain and its subdomains.
+type BlocklistConfig struct {
+	Name    string /// shown in logs, defaults to the file name
+	File    string
+	Format  string /// "hosts", "plain", "adblock", or "" to work it out line by line
+	Action  string /// "deny" (the default) or "drop"
+	Refresh string /// how often to check the file for changes and re-read it, e.g. "1h" - never by default
+}
+
+// / A set of domains, looked up by walking the host's suffixes at each label so the cost depends on the
+// / length of the host rather than the size of the list
+type DomainSet struct {
+	domains    map[string]struct{}
+	exceptions map[string]struct{}
+}
+
+func NewDomainSet() *DomainSet {
+	return &DomainSet{domains: make(map[string]struct{}), exceptions: make(map[string]struct{})}
+}
+
+func (d *DomainSet) Len() int {
+	return len(d.domains)
+}
+
+func (d *DomainSet) Add(domain string) {
+	d.domains[domain] = struct{}{}
+}
+
+// / Never match domain or its subdomains, whatever else is in the set
+func (d *DomainSet) Except(domain string) {
+	d.exceptions[domain] = struct{}{}
+}
+
+func (d *DomainSet) Match(host string) bool {
+	matched := false
+	for suffix := host; suffix != ""; {
+		if _, ok := d.exceptions[suffix]; ok {
+			return false
+		}
+		if _, ok := d.domains[suffix]; ok {
+			matched = true
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+	return matched
+}
+
+// / Names hosts files map to themselves rather than to block
+var localNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+func cleanDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	domain = strings.TrimPrefix(domain, "*.")
+	if domain == "" || localNames[domain] || net.ParseIP(domain) != nil || strings.ContainsAny(domain, "/*^$|@ ") {
+		return ""
+	}
+	return domain
+}
+
+// / Read a domain list, skipping anything that isn't a plain domain entry
+func LoadDomainSet(path string, format string) (*DomainSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := NewDomainSet()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		lineformat := format
+		if lineformat == "" {
+			fields := strings.Fields(line)
+			switch {
+			case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"):
+				lineformat = FORMATADBLOCK
+			case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+				lineformat = FORMATHOSTS
+			default:
+				lineformat = FORMATPLAIN
+			}
+		}
+		switch lineformat {
+		case FORMATHOSTS:
+			if comment := strings.IndexByte(line, '#'); comment >= 0 {
+				line = line[:comment]
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+				continue
+			}
+			for _, name := range fields[1:] {
+				if domain := cleanDomain(name); domain != "" {
+					set.Add(domain)
+				}
+			}
+		case FORMATPLAIN:
+			if comment := strings.IndexByte(line, '#'); comment >= 0 {
+				line = line[:comment]
+			}
+			if domain := cleanDomain(line); domain != "" {
+				set.Add(domain)
+			}
+		case FORMATADBLOCK:
+			exception := strings.HasPrefix(line, "@@")
+			line = strings.TrimPrefix(line, "@@")
+			if !strings.HasPrefix(line, "||") {
+				continue /// path and cosmetic rules mean nothing for a CONNECT
+			}
+			line = strings.TrimSuffix(line[2:], "^")
+			if domain := cleanDomain(line); domain != "" {
+				if exception {
+					set.Except(domain)
+				} else {
+					set.Add(domain)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown blocklist format %s", format)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// / A domain list loaded from a file, re-read in the background when the file changes
+type Blocklist struct {
+	name    string
+	path    string
+	format  string
+	domains atomic.Pointer[DomainSet]
+	modtime time.Time
+	done    chan struct{}
+	closed  sync.Once
+}
+
+func NewBlocklist(cfg *BlocklistConfig) (*Blocklist, error) {
+	b := &Blocklist{
+		name:   cfg.Name,
+		path:   configs.Expand(cfg.File),
+		format: strings.ToLower(cfg.Format),
+		done:   make(chan struct{}),
+	}
+	if b.name == "" {
+		b.name = b.path
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	if cfg.Refresh != "" {
+		interval, err := time.ParseDuration(cfg.Refresh)
+		if err != nil {
+			return nil, err
+		}
+		go b.refresh(interval)
+	}
+	return b, nil
+}
+
+func (b *Blocklist) load() error {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return err
+	}
+	set, err := LoadDomainSet(b.path, b.format)
+	if err != nil {
+		return err
+	}
+	b.domains.Store(set)
+	b.modtime = info.ModTime()
+	fmt.Println("Blocklist", b.name, "loaded", set.Len(), "domains")
+	return nil
+}
+
+func (b *Blocklist) refresh(interval time.Duration) {
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-time.After(interval):
+		}
+		info, err := os.Stat(b.path)
+		if err != nil || info.ModTime().Equal(b.modtime) {
+			continue
+		}
+		if err := b.load(); err != nil {
+			log.Println("Unable to re-read blocklist", b.name, "keeping the old one", err)
+		}
+	}
+}
+
+func (b *Blocklist) Match(host string) bool {
+	return b.domains.Load().Match(host)
+}
+
+// / Stop re-reading the file - safe to call more than once
+func (b *Blocklist) Close() {
+	b.closed.Do(func() { close(b.done) })
+}
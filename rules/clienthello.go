@@ -0,0 +1,133 @@
+package rules
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotTls     = errors.New("not a tls client hello")
+	ErrIncomplete = errors.New("client hello incomplete")
+)
+
+const (
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 1
+	extServerName      = 0
+	extAlpn            = 16
+)
+
+type ClientHello struct {
+	ServerName string
+	Alpn       []string
+}
+
+// / Does this look like the start of a tls session - a handshake record header
+func looksLikeTls(data []byte) bool {
+	return len(data) > 0 && data[0] == tlsRecordHandshake && (len(data) < 2 || data[1] == 3)
+}
+
+// / Pull the client hello out of the first bytes of a tls session. It may be split across several
+// / records, ErrIncomplete means more data is needed.
+func ParseClientHello(data []byte) (*ClientHello, error) {
+	var handshake []byte
+	for {
+		if len(data) < 5 {
+			return nil, ErrIncomplete
+		}
+		if data[0] != tlsRecordHandshake || data[1] != 3 {
+			return nil, ErrNotTls
+		}
+		reclen := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+reclen {
+			return nil, ErrIncomplete
+		}
+		handshake = append(handshake, data[5:5+reclen]...)
+		data = data[5+reclen:]
+		if len(handshake) >= 4 {
+			if handshake[0] != tlsClientHello {
+				return nil, ErrNotTls
+			}
+			msglen := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+msglen {
+				return parseHelloBody(handshake[4 : 4+msglen])
+			}
+		}
+	}
+}
+
+// / A cursor over the hello that fails closed on any truncation
+type helloReader struct {
+	data []byte
+	err  bool
+}
+
+func (r *helloReader) take(n int) []byte {
+	if r.err || len(r.data) < n {
+		r.err = true
+		return nil
+	}
+	taken := r.data[:n]
+	r.data = r.data[n:]
+	return taken
+}
+
+func (r *helloReader) vector(lenbytes int) []byte {
+	header := r.take(lenbytes)
+	if r.err {
+		return nil
+	}
+	n := 0
+	for _, b := range header {
+		n = n<<8 | int(b)
+	}
+	return r.take(n)
+}
+
+func parseHelloBody(body []byte) (*ClientHello, error) {
+	hello := &ClientHello{}
+	r := &helloReader{data: body}
+	r.take(2 + 32) /// version, random
+	r.vector(1)    /// session id
+	r.vector(2)    /// cipher suites
+	r.vector(1)    /// compression methods
+	if r.err {
+		return nil, ErrNotTls
+	}
+	if len(r.data) == 0 {
+		return hello, nil /// no extensions at all
+	}
+	exts := &helloReader{data: r.vector(2)}
+	for len(exts.data) > 0 && !exts.err {
+		header := exts.take(2)
+		ext := &helloReader{data: exts.vector(2)}
+		if exts.err {
+			break
+		}
+		exttype := binary.BigEndian.Uint16(header)
+		switch exttype {
+		case extServerName:
+			names := &helloReader{data: ext.vector(2)}
+			for len(names.data) > 0 && !names.err {
+				nametype := names.take(1)
+				name := names.vector(2)
+				if !names.err && nametype[0] == 0 {
+					hello.ServerName = strings.TrimSuffix(strings.ToLower(string(name)), ".")
+				}
+			}
+		case extAlpn:
+			protos := &helloReader{data: ext.vector(2)}
+			for len(protos.data) > 0 && !protos.err {
+				proto := protos.vector(1)
+				if !protos.err {
+					hello.Alpn = append(hello.Alpn, string(proto))
+				}
+			}
+		}
+	}
+	if exts.err {
+		return nil, ErrNotTls
+	}
+	return hello, nil
+}
@@ -2,38 +2,196 @@ package rules
 
 import (
 	"fmt"
+	"log"
 	"regexp"
 	"strings"
+	"time"
 )
 
+// / One allow/deny entry in connect-rules.json - the first entry to match a destination decides
+type RuleEntry struct {
+	Name     string          /// shown in logs, defaults to the entry's position
+	Action   string          /// "allow", "deny" (respond with a failure) or "drop" (close without a response)
+	Hosts    []string        /// "example.com", "*.example.com", ".example.com" or "re:<regex>"
+	Ports    []string        /// "443" or "8000-8999"
+	Cidrs    []string        /// for destinations given as ip literals, e.g. "10.0.0.0/8", "2001:db8::/32"
+	Alpn     []string        /// only match tls sessions offering one of these protocols, e.g. "h2" - needs Sni enabled
+	Reply    *DenyReply      /// for "deny" - overrides the rule set's DenyReply
+	Schedule *ScheduleConfig /// only apply this entry at these times
+}
+
+// / Turn an action name from the config into a RuleResponse
+func ParseAction(action string) (RuleResponse, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		return ALLOW, nil
+	case "deny", "fail":
+		return REPSONDFAIL, nil
+	case "drop":
+		return DROPFLAT, nil
+	}
+	return UNDEFINED, fmt.Errorf("unknown rule action %s", action)
+}
+
+type connectEntry struct {
+	name     string
+	action   RuleResponse
+	reply    *DenyReply
+	matcher  *DestinationMatcher
+	alpn     []string
+	hostport *regexp.Regexp /// the old Whitelist/Blacklist patterns match against the whole host:port
+	domains  *Blocklist
+	schedule *Schedule
+}
+
+func (e *connectEntry) match(dest *Destination, hostport string, alpn []string, now time.Time) bool {
+	if e.schedule != nil && !e.schedule.Active(now) {
+		return false
+	}
+	if e.hostport != nil {
+		return e.hostport.MatchString(hostport)
+	}
+	if e.domains != nil {
+		return dest.IP == nil && e.domains.Match(dest.Host)
+	}
+	if len(e.alpn) > 0 && !anyOf(e.alpn, alpn) {
+		return false
+	}
+	return e.matcher.Match(dest)
+}
+
+func anyOf(want []string, have []string) bool {
+	for _, w := range want {
+		for _, h := range have {
+			if w == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type ConnectRules struct {
-	whitelist    []*regexp.Regexp /// acceptable patterns
+	entries      []*connectEntry
+	ports        *PortMatcher /// WhitelistPorts - if set, nothing else is allowed
 	defaultAllow RuleResponse
+	reply        *DenyReply
+	blocklists   []*Blocklist
 }
 
-func NewConnectRules(whitelistpattern []string) *ConnectRules {
+// / Rules are checked in this order - WhitelistPorts, Rules, Blocklists, Blacklist, Whitelist, then the default
+func NewConnectRules(cfg *ConnectConfig) *ConnectRules {
 	crules := &ConnectRules{
-		whitelist: make([]*regexp.Regexp, len(whitelistpattern)),
+		ports:        &PortMatcher{},
+		defaultAllow: DROPFLAT,
+		reply:        defaultDenyReply,
+	}
+	if cfg.DenyReply != nil {
+		cfg.DenyReply.Expand()
+		crules.reply = cfg.DenyReply
+	}
+	for _, port := range cfg.WhitelistPorts {
+		crules.ports.ranges = append(crules.ports.ranges, [2]int{port, port})
+	}
+	if cfg.Default != "" {
+		action, err := ParseAction(cfg.Default)
+		if err != nil {
+			log.Panicln(err)
+		}
+		crules.defaultAllow = action
 	}
 
-	for i, rulepattern := range whitelistpattern {
+	for i, entry := range cfg.Rules {
+		action, err := ParseAction(entry.Action)
+		if err != nil {
+			log.Panicln("Rule", i, err)
+		}
+		matcher, err := NewDestinationMatcher(entry.Hosts, entry.Ports, entry.Cidrs)
+		if err != nil {
+			log.Panicln("Rule", i, err)
+		}
+		name := entry.Name
+		if name == "" {
+			name = fmt.Sprint("rule-", i)
+		}
+		reply := crules.reply
+		if entry.Reply != nil {
+			entry.Reply.Expand()
+			reply = entry.Reply
+		}
+		var schedule *Schedule
+		if entry.Schedule != nil {
+			schedule, err = NewSchedule(entry.Schedule)
+			if err != nil {
+				log.Panicln("Rule", i, err)
+			}
+		}
+		crules.entries = append(crules.entries, &connectEntry{name: name, action: action, reply: reply, matcher: matcher, alpn: entry.Alpn, schedule: schedule})
+	}
+	for i := range cfg.Blocklists {
+		listcfg := &cfg.Blocklists[i]
+		action := REPSONDFAIL
+		if listcfg.Action != "" {
+			var err error
+			action, err = ParseAction(listcfg.Action)
+			if err != nil || action == ALLOW {
+				log.Panicln("Blocklist", listcfg.File, "action must be deny or drop", listcfg.Action)
+			}
+		}
+		list, err := NewBlocklist(listcfg)
+		if err != nil {
+			crules.Close()
+			log.Panicln("Unable to load blocklist", listcfg.File, err)
+		}
+		crules.blocklists = append(crules.blocklists, list)
+		crules.entries = append(crules.entries, &connectEntry{name: "blocklist:" + list.name, action: action, reply: crules.reply, domains: list})
+	}
+	for _, rulepattern := range cfg.Blacklist {
+		reg := regexp.MustCompile(rulepattern)
+		crules.entries = append(crules.entries, &connectEntry{name: "blacklist:" + rulepattern, action: DROPFLAT, reply: crules.reply, hostport: reg})
+	}
+	for _, rulepattern := range cfg.Whitelist {
 		reg := regexp.MustCompile(rulepattern)
-		crules.whitelist[i] = reg
+		crules.entries = append(crules.entries, &connectEntry{name: "whitelist:" + rulepattern, action: ALLOW, reply: crules.reply, hostport: reg})
 	}
-	crules.defaultAllow = DROPFLAT
 	return crules
 }
 
-func (c *ConnectRules) Allow(data []byte) RuleResponse {
-	if !strings.HasPrefix(string(data), "CONNECT") {
-		return UNDEFINED
+// / Every request is checked by where it's going - a CONNECT's target, or a plain http request's url or
+// / Host header - so a GET http://blocked.example/ is held to the same rules as a CONNECT to it
+func (c *ConnectRules) Allow(req *Request) Verdict {
+	return c.evaluate(req.Target, nil, req.Time)
+}
+
+// / now is when the session started - schedules are checked against it, not the time of each request
+func (c *ConnectRules) evaluate(hostport string, alpn []string, now time.Time) Verdict {
+	if now.IsZero() {
+		now = time.Now()
+	}
+	dest, err := ParseDestination(hostport)
+	if err != nil {
+		fmt.Println("Invalid CONNECT destination ", hostport, err)
+		return Verdict{Response: c.defaultAllow, Rule: "invalid-destination", Reply: c.reply}
+	}
+	if !c.ports.Empty() && !c.ports.Match(dest.Port) {
+		return Verdict{Response: DROPFLAT, Rule: "whitelist-ports"}
 	}
-	host := strings.Split(string(data), " ")[1]
-	for _, rule := range c.whitelist {
-		fmt.Println("Try match ", rule, " with ", host)
-		if rule.MatchString(host) {
-			return ALLOW
+	for _, entry := range c.entries {
+		if entry.match(dest, hostport, alpn, now) {
+			return Verdict{Response: entry.action, Rule: entry.name, Reply: entry.reply}
 		}
 	}
-	return c.defaultAllow
+	return Verdict{Response: c.defaultAllow, Rule: "default", Reply: c.reply}
+}
+
+// / What happens to a session the rules can't place - the configured Default
+func (c *ConnectRules) defaultVerdict(rule string) Verdict {
+	return Verdict{Response: c.defaultAllow, Rule: rule, Reply: c.reply}
+}
+
+// / Stop re-reading blocklists - once a reload has replaced these rules
+func (c *ConnectRules) Close() {
+	for _, list := range c.blocklists {
+		list.Close()
+	}
 }
@@ -0,0 +1,211 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// / Where a connection is going, parsed from a host:port string
+type Destination struct {
+	Host string
+	Port int
+	IP   net.IP /// set if the host is an ip literal
+}
+
+func ParseDestination(hostport string) (*Destination, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	portnum, err := strconv.Atoi(port)
+	if err != nil || portnum < 0 || portnum > 65535 {
+		return nil, fmt.Errorf("invalid port in %s", hostport)
+	}
+	dest := &Destination{
+		Host: strings.TrimSuffix(strings.ToLower(host), "."),
+		Port: portnum,
+	}
+	dest.IP = net.ParseIP(dest.Host)
+	return dest, nil
+}
+
+func (d *Destination) String() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
+// / Host patterns - "example.com" matches exactly, "*.example.com" and ".example.com" match any
+// / subdomain, and "re:<regex>" matches the host against a regular expression, ignoring case
+type HostMatcher struct {
+	exact    map[string]bool
+	suffixes []string
+	regexes  []*regexp.Regexp
+}
+
+func NewHostMatcher(patterns []string) (*HostMatcher, error) {
+	h := &HostMatcher{exact: make(map[string]bool)}
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			/// compiled as written - lowercasing would change classes like \D - but hosts are lowercase, so
+			/// match case-insensitively
+			reg, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, err
+			}
+			h.regexes = append(h.regexes, reg)
+			continue
+		}
+		pattern = strings.ToLower(pattern)
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			h.suffixes = append(h.suffixes, pattern[1:])
+		case strings.HasPrefix(pattern, "."):
+			h.suffixes = append(h.suffixes, pattern)
+		case pattern == "":
+			return nil, fmt.Errorf("empty host pattern")
+		default:
+			h.exact[pattern] = true
+		}
+	}
+	return h, nil
+}
+
+func (h *HostMatcher) Empty() bool {
+	return len(h.exact) == 0 && len(h.suffixes) == 0 && len(h.regexes) == 0
+}
+
+func (h *HostMatcher) Match(host string) bool {
+	if h.exact[host] {
+		return true
+	}
+	for _, suffix := range h.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	for _, reg := range h.regexes {
+		if reg.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// / Ports and port ranges - "443", "8000-8999"
+type PortMatcher struct {
+	ranges [][2]int
+}
+
+func NewPortMatcher(specs []string) (*PortMatcher, error) {
+	p := &PortMatcher{}
+	for _, spec := range specs {
+		low, high, found := strings.Cut(strings.TrimSpace(spec), "-")
+		if !found {
+			high = low
+		}
+		lowport, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s", spec)
+		}
+		highport, err := strconv.Atoi(high)
+		if err != nil || highport < lowport {
+			return nil, fmt.Errorf("invalid port range %s", spec)
+		}
+		p.ranges = append(p.ranges, [2]int{lowport, highport})
+	}
+	return p, nil
+}
+
+func (p *PortMatcher) Empty() bool {
+	return len(p.ranges) == 0
+}
+
+func (p *PortMatcher) Match(port int) bool {
+	for _, portrange := range p.ranges {
+		if port >= portrange[0] && port <= portrange[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// / IPv4 and IPv6 blocks, e.g. "10.0.0.0/8", "fd00::/8". A bare address is a block of one.
+type CidrMatcher struct {
+	nets []*net.IPNet
+}
+
+func NewCidrMatcher(cidrs []string) (*CidrMatcher, error) {
+	c := &CidrMatcher{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		c.nets = append(c.nets, ipnet)
+	}
+	return c, nil
+}
+
+func (c *CidrMatcher) Empty() bool {
+	return len(c.nets) == 0
+}
+
+func (c *CidrMatcher) Match(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range c.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// / The destination part of a rule - host patterns or cidrs pick the destination (either may match),
+// / ports narrow it down. Anything left empty matches everything.
+type DestinationMatcher struct {
+	hosts *HostMatcher
+	ports *PortMatcher
+	cidrs *CidrMatcher
+}
+
+func NewDestinationMatcher(hosts []string, ports []string, cidrs []string) (*DestinationMatcher, error) {
+	var err error
+	d := &DestinationMatcher{}
+	if d.hosts, err = NewHostMatcher(hosts); err != nil {
+		return nil, err
+	}
+	if d.ports, err = NewPortMatcher(ports); err != nil {
+		return nil, err
+	}
+	if d.cidrs, err = NewCidrMatcher(cidrs); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DestinationMatcher) Match(dest *Destination) bool {
+	if !d.ports.Empty() && !d.ports.Match(dest.Port) {
+		return false
+	}
+	if d.hosts.Empty() && d.cidrs.Empty() {
+		return true
+	}
+	return d.hosts.Match(dest.Host) || d.cidrs.Match(dest.IP)
+}
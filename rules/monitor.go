@@ -0,0 +1,100 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	MODEENFORCE = "enforce"
+	MODEMONITOR = "monitor" /// evaluate and log, but let everything through
+)
+
+// / Distinct destinations counted before the rest are lumped together, so the counts can't grow without bound
+const maxMonitorDestinations = 10000
+
+// / Counts what a rule set in monitor mode would have blocked
+type Monitor struct {
+	lock     sync.Mutex
+	counts   map[string]int /// "destination - action by rule" -> times it would have been blocked
+	interval time.Duration
+	done     chan struct{}
+}
+
+func NewMonitor(interval time.Duration) *Monitor {
+	m := &Monitor{counts: make(map[string]int), interval: interval, done: make(chan struct{})}
+	if interval > 0 {
+		go m.summarise()
+	}
+	return m
+}
+
+// / Note a request that would have been blocked, and turn the verdict into an allow
+func (m *Monitor) Record(req *Request, verdict Verdict) Verdict {
+	target := req.Target
+	if target == "" {
+		target = "(not http)"
+	}
+	log.Println("Monitor: would have blocked", target, verdict)
+	key := fmt.Sprint(target, " - ", verdict.Response, " by ", verdict.Rule)
+	m.lock.Lock()
+	if _, ok := m.counts[key]; ok || len(m.counts) < maxMonitorDestinations {
+		m.counts[key]++
+	} else {
+		m.counts["(other destinations)"]++
+	}
+	m.lock.Unlock()
+	return Verdict{Response: ALLOW, Rule: verdict.Rule, WouldBlock: verdict.Response}
+}
+
+// / A copy of the would-be-blocked counts
+func (m *Monitor) Counts() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := make(map[string]int, len(m.counts))
+	for key, count := range m.counts {
+		counts[key] = count
+	}
+	return counts
+}
+
+// / Log the most blocked destinations so far
+func (m *Monitor) LogSummary() {
+	counts := m.Counts()
+	keys := make([]string, 0, len(counts))
+	total := 0
+	for key, count := range counts {
+		keys = append(keys, key)
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return counts[keys[i]] > counts[keys[j]] })
+	log.Println("Monitor: would have blocked", total, "requests to", len(keys), "destinations")
+	for i, key := range keys {
+		if i == 20 {
+			break
+		}
+		log.Println("Monitor:", counts[key], key)
+	}
+}
+
+func (m *Monitor) summarise() {
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-time.After(m.interval):
+			m.LogSummary()
+		}
+	}
+}
+
+func (m *Monitor) Close() {
+	close(m.done)
+	m.LogSummary()
+}
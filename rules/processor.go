@@ -1,34 +1,179 @@
 package rules
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
 
 type ConnectConfig struct {
-	Whitelist []string
+	Whitelist      []string          /// regexes matched against the CONNECT host:port, e.g. ".*[\.]google.com:443"
+	Blacklist      []string          /// regexes matched against the CONNECT host:port, dropped even if whitelisted
+	WhitelistPorts []int             /// if set, only these ports are allowed
+	Rules          []RuleEntry       /// ordered allow/deny entries, checked before the Blacklist and Whitelist
+	Blocklists     []BlocklistConfig /// domain list files, checked after Rules so they can allow exceptions
+	Default        string            /// action if nothing matches - "allow", "deny" or "drop" (the default)
+	Ssrf           *SsrfConfig       /// resolve destinations here and refuse private/internal addresses
+	DenyReply      *DenyReply        /// what "deny" sends the client, a bare 403 by default
+	Sni            *SniConfig        /// apply the rules to raw tls sessions by server name
+	Audit          *AuditConfig      /// record every decision, and every session's traffic, to a jsonl file
+	Mode           string            /// "enforce" (the default), or "monitor" to log what would be blocked but allow it
+	MonitorSummary string            /// in monitor mode, how often to log the most blocked destinations - defaults to 10m
+
+	Chain    []ChainEntry              /// optional - the rules to run, in order, by registered type. Defaults to just this file's rules
+	RuleSets map[string]*ConnectConfig /// named rule sets a proxy key can use instead of these, see ProxyContent.RuleSet
 }
 
 func (c *ConnectConfig) Expand() {
 }
 
 type Processor struct {
-	rules []Rule
+	connect *ConnectRules
+	rules   []Rule
+	guard   *AddressGuard
+	reply   *DenyReply
+	sni     *SniConfig
+	audit   *AuditLog
+	monitor *Monitor /// nil unless in monitor mode
+
+	Clock func() time.Time /// when sessions start, for scheduled rules - swap it out to test schedules
 }
 
 func NewProcessor(conncfg *ConnectConfig) *Processor {
+	connect := NewConnectRules(conncfg)
 	proc := &Processor{
-		rules: []Rule{NewConnectRules(conncfg.Whitelist)},
+		connect: connect,
+		Clock:   time.Now,
+	}
+	own := []Rule{connect}
+	if conncfg.Sni != nil && conncfg.Sni.Enabled {
+		proc.sni = conncfg.Sni
+		own = append(own, NewSniRules(connect, conncfg.Sni))
+	}
+	proc.rules = own
+	defer func() {
+		if r := recover(); r != nil {
+			proc.Close() /// stop the blocklists re-reading, this processor won't be used
+			panic(r)
+		}
+	}()
+	if len(conncfg.Chain) > 0 {
+		proc.rules = nil
+		ownadded := false
+		for i, entry := range conncfg.Chain {
+			if entry.Type == "connect" && len(entry.Config) == 0 {
+				if ownadded {
+					log.Panicln("Chain entry", i, "lists this file's connect rules a second time")
+				}
+				proc.rules = append(proc.rules, own...)
+				ownadded = true
+				continue
+			}
+			rule, err := NewRule(entry.Type, entry.Config)
+			if err != nil {
+				log.Panicln("Chain entry", i, err)
+			}
+			proc.rules = append(proc.rules, rule)
+		}
+	}
+	proc.reply = defaultDenyReply
+	if conncfg.DenyReply != nil {
+		conncfg.DenyReply.Expand()
+		proc.reply = conncfg.DenyReply
+	}
+	if conncfg.Audit != nil && conncfg.Audit.File != "" {
+		audit, err := OpenAuditLog(conncfg.Audit)
+		if err != nil {
+			log.Panicln("Unable to open the audit log", err)
+		}
+		proc.audit = audit
+	}
+	if conncfg.Ssrf != nil && conncfg.Ssrf.Enabled {
+		guard, err := NewAddressGuard(conncfg.Ssrf)
+		if err != nil {
+			log.Panicln("Invalid Ssrf config", err)
+		}
+		proc.guard = guard
 	}
-	for _, rule := range proc.rules {
-		fmt.Println("CONNECTION rule added ", rule)
+	switch strings.ToLower(conncfg.Mode) {
+	case "", MODEENFORCE:
+	case MODEMONITOR:
+		interval := 10 * time.Minute
+		if conncfg.MonitorSummary != "" {
+			var err error
+			interval, err = time.ParseDuration(conncfg.MonitorSummary)
+			if err != nil {
+				log.Panicln("Invalid MonitorSummary", err)
+			}
+		}
+		fmt.Println("Connect rules in monitor mode - nothing will be blocked")
+		proc.monitor = NewMonitor(interval)
+	default:
+		log.Panicln("Unknown connect rules mode", conncfg.Mode)
 	}
 	return proc
 }
 
-func (p *Processor) Allow(data []byte) RuleResponse {
+// / Release anything running in the background, when the processor has been replaced
+func (p *Processor) Close() {
+	closedconnect := false
 	for _, rule := range p.rules {
-		resp := rule.Allow(data)
-		if resp != UNDEFINED {
-			return resp
+		if closer, ok := rule.(interface{ Close() }); ok {
+			closer.Close()
+			closedconnect = closedconnect || rule == Rule(p.connect)
 		}
 	}
-	return ALLOW
+	if !closedconnect {
+		p.connect.Close()
+	}
+	if p.monitor != nil {
+		p.monitor.Close()
+	}
+}
+
+// / The monitor mode counts, nil if the rules are enforced
+func (p *Processor) Monitor() *Monitor {
+	return p.monitor
+}
+
+// / Let a blocking verdict through if we're only monitoring
+func (p *Processor) enforce(req *Request, verdict Verdict) Verdict {
+	if p.monitor == nil || verdict.Response == ALLOW || verdict.Response == UNDEFINED {
+		return verdict
+	}
+	return p.monitor.Record(req, verdict)
+}
+
+// / The audit log, nil if there isn't one
+func (p *Processor) Audit() *AuditLog {
+	return p.audit
+}
+
+// / Evaluate one complete request - see Session for evaluating a stream
+func (p *Processor) Allow(req *Request) Verdict {
+	for _, rule := range p.rules {
+		verdict := rule.Allow(req)
+		if verdict.Response == REPSONDFAIL && verdict.Reply == nil {
+			verdict.Reply = p.reply
+		}
+		if verdict.Response != UNDEFINED {
+			return p.enforce(req, verdict)
+		}
+	}
+	return Verdict{Response: ALLOW}
+}
+
+// / Run an allowed request past the address guard, if there is one. The request may come back rewritten.
+// / Monitor mode doesn't apply - it's for trying out connect rules, not for letting requests reach
+// / internal addresses.
+func (p *Processor) Guard(req *Request) Verdict {
+	if p.guard == nil {
+		return Verdict{Response: ALLOW}
+	}
+	resp := p.guard.Guard(req)
+	if resp == UNDEFINED {
+		return Verdict{Response: ALLOW}
+	}
+	return Verdict{Response: resp, Rule: "ssrf", Reply: p.reply}
 }
@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// / Builds a rule from the Config of its entry in a Chain. Rules that run anything in the background
+// / should also have a Close() method, it's called when the rule set is replaced.
+type RuleFactory func(config json.RawMessage) (Rule, error)
+
+// / One rule in connect-rules.json's Chain
+type ChainEntry struct {
+	Type   string          /// a registered rule type - "connect" with no Config is this file's own rules
+	Config json.RawMessage /// handed to the rule type's factory
+}
+
+var (
+	registrylock sync.Mutex
+	registry     = make(map[string]RuleFactory)
+)
+
+// / Make a rule type available to Chain entries. Call it from an init function - registering the same
+// / name twice panics.
+func Register(name string, factory RuleFactory) {
+	registrylock.Lock()
+	defer registrylock.Unlock()
+	if _, ok := registry[name]; ok {
+		log.Panicln("Rule type registered twice", name)
+	}
+	registry[name] = factory
+}
+
+func RegisteredRules() []string {
+	registrylock.Lock()
+	defer registrylock.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// / Build a rule of a registered type. A factory that panics, as the config parsing in this package
+// / tends to, comes back as an error.
+func NewRule(name string, config json.RawMessage) (rule Rule, err error) {
+	registrylock.Lock()
+	factory, ok := registry[name]
+	registrylock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown rule type %s", name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", name, r)
+		}
+	}()
+	return factory(config)
+}
+
+func init() {
+	/// Another set of connect rules, laid out like connect-rules.json
+	Register("connect", func(config json.RawMessage) (Rule, error) {
+		cfg := &ConnectConfig{}
+		if err := json.Unmarshal(config, cfg); err != nil {
+			return nil, err
+		}
+		return NewConnectRules(cfg), nil
+	})
+}
@@ -0,0 +1,70 @@
+package rules
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// / The global rules from connect-rules.json, plus the named sets under RuleSets that a proxy key can
+// / pick instead. Keys that don't name a set get the global rules.
+type RuleSets struct {
+	config *ConnectConfig
+	global *Processor
+	named  map[string]*Processor
+}
+
+func NewRuleSets(cfg *ConnectConfig) *RuleSets {
+	sets := &RuleSets{config: cfg, named: make(map[string]*Processor)}
+	defer func() {
+		if r := recover(); r != nil {
+			sets.Close() /// stop anything the sets built so far started
+			panic(r)
+		}
+	}()
+	sets.global = NewProcessor(cfg)
+	for name, setcfg := range cfg.RuleSets {
+		if len(setcfg.RuleSets) > 0 {
+			log.Panicln("Rule set", name, "can't have rule sets of its own")
+		}
+		fmt.Println("Rule set", name)
+		sets.named[name] = NewProcessor(setcfg)
+	}
+	return sets
+}
+
+// / The rules for a proxy key's rule set, "" for the global rules
+func (r *RuleSets) Get(name string) *Processor {
+	if proc, ok := r.named[name]; ok {
+		return proc
+	}
+	return r.global
+}
+
+// / The connect-rules.json these were built from
+func (r *RuleSets) Config() *ConnectConfig {
+	return r.config
+}
+
+func (r *RuleSets) Has(name string) bool {
+	_, ok := r.named[name]
+	return name == "" || ok
+}
+
+func (r *RuleSets) Names() []string {
+	names := make([]string, 0, len(r.named))
+	for name := range r.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *RuleSets) Close() {
+	if r.global != nil {
+		r.global.Close()
+	}
+	for _, proc := range r.named {
+		proc.Close()
+	}
+}
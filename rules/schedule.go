@@ -0,0 +1,122 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// / When a rule entry applies - outside the schedule the entry is skipped as if it didn't match
+type ScheduleConfig struct {
+	Days     []string /// "mon", "tue" ... or ranges like "mon-fri" - every day if empty
+	Times    []string /// "09:00-17:30", or "22:00-06:00" to run past midnight - all day if empty
+	Timezone string   /// e.g. "Europe/London", defaults to the local timezone
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+type Schedule struct {
+	days     [7]bool
+	windows  [][2]int /// minutes since midnight, start inclusive, end exclusive
+	location *time.Location
+}
+
+func parseWeekday(day string) (time.Weekday, error) {
+	day = strings.ToLower(strings.TrimSpace(day))
+	if len(day) > 3 {
+		day = day[:3]
+	}
+	weekday, ok := weekdays[day]
+	if !ok {
+		return 0, fmt.Errorf("invalid day %s", day)
+	}
+	return weekday, nil
+}
+
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		if strings.TrimSpace(clock) == "24:00" {
+			return 24 * 60, nil
+		}
+		return 0, fmt.Errorf("invalid time %s", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+func NewSchedule(cfg *ScheduleConfig) (*Schedule, error) {
+	s := &Schedule{location: time.Local}
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		s.location = location
+	}
+	if len(cfg.Days) == 0 {
+		s.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, spec := range cfg.Days {
+		first, last, isrange := strings.Cut(spec, "-")
+		if !isrange {
+			last = first
+		}
+		from, err := parseWeekday(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseWeekday(last)
+		if err != nil {
+			return nil, err
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			s.days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	for _, spec := range cfg.Times {
+		first, last, isrange := strings.Cut(spec, "-")
+		if !isrange {
+			return nil, fmt.Errorf("invalid time range %s", spec)
+		}
+		from, err := parseClock(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(last)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, [2]int{from, to})
+	}
+	return s, nil
+}
+
+// / Is the schedule active at t. A window that runs past midnight belongs to the day it starts on.
+func (s *Schedule) Active(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	if len(s.windows) == 0 {
+		return s.days[t.Weekday()]
+	}
+	for _, window := range s.windows {
+		if window[0] <= window[1] {
+			if s.days[t.Weekday()] && minute >= window[0] && minute < window[1] {
+				return true
+			}
+			continue
+		}
+		if s.days[t.Weekday()] && minute >= window[0] {
+			return true
+		}
+		if s.days[(t.Weekday()+6)%7] && minute < window[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+// / 2026-01-05 is a Monday
+func at(t *testing.T, value string) time.Time {
+	t.Helper()
+	when, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return when
+}
+
+func TestScheduleActive(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    ScheduleConfig
+		when   string
+		active bool
+	}{
+		{"overnight evening", ScheduleConfig{Days: []string{"mon"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-05T23:30:00Z", true},
+		{"overnight next morning", ScheduleConfig{Days: []string{"mon"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-06T05:59:00Z", true},
+		{"overnight ends", ScheduleConfig{Days: []string{"mon"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-06T06:00:00Z", false},
+		{"overnight belongs to the start day", ScheduleConfig{Days: []string{"mon"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-05T05:00:00Z", false},
+		{"overnight daytime", ScheduleConfig{Days: []string{"mon"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-05T12:00:00Z", false},
+		{"days wrap past sunday - saturday", ScheduleConfig{Days: []string{"fri-mon"}, Timezone: "UTC"}, "2026-01-03T12:00:00Z", true},
+		{"days wrap past sunday - sunday", ScheduleConfig{Days: []string{"fri-mon"}, Timezone: "UTC"}, "2026-01-04T12:00:00Z", true},
+		{"days wrap past sunday - monday", ScheduleConfig{Days: []string{"fri-mon"}, Timezone: "UTC"}, "2026-01-05T12:00:00Z", true},
+		{"days wrap past sunday - tuesday", ScheduleConfig{Days: []string{"fri-mon"}, Timezone: "UTC"}, "2026-01-06T12:00:00Z", false},
+		{"sunday overnight into monday", ScheduleConfig{Days: []string{"sun"}, Times: []string{"22:00-06:00"}, Timezone: "UTC"}, "2026-01-05T01:00:00Z", true},
+		{"timezone ahead of utc", ScheduleConfig{Times: []string{"09:00-17:00"}, Timezone: "Asia/Tokyo"}, "2026-01-05T00:30:00Z", true},
+		{"timezone outside hours", ScheduleConfig{Times: []string{"09:00-17:00"}, Timezone: "Asia/Tokyo"}, "2026-01-05T12:00:00Z", false},
+		{"timezone changes the day", ScheduleConfig{Days: []string{"tue"}, Timezone: "Asia/Tokyo"}, "2026-01-05T20:00:00Z", true},
+	}
+	for _, c := range cases {
+		schedule, err := NewSchedule(&c.cfg)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if active := schedule.Active(at(t, c.when)); active != c.active {
+			t.Errorf("%s: active at %s is %v, expected %v", c.name, c.when, active, c.active)
+		}
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, cfg := range []ScheduleConfig{
+		{Days: []string{"someday"}},
+		{Times: []string{"09:00"}},
+		{Times: []string{"25:00-26:00"}},
+		{Timezone: "Nowhere/Special"},
+	} {
+		if _, err := NewSchedule(&cfg); err == nil {
+			t.Errorf("%+v should be invalid", cfg)
+		}
+	}
+}
+
+// / The clock is read once when the session starts - a session that started inside the schedule keeps
+// / the scheduled rule for its later requests
+func TestScheduleAtSessionStart(t *testing.T) {
+	proc := NewProcessor(&ConnectConfig{
+		Rules: []RuleEntry{{
+			Action:   "allow",
+			Hosts:    []string{"work.example"},
+			Schedule: &ScheduleConfig{Days: []string{"mon-fri"}, Times: []string{"09:00-17:00"}, Timezone: "UTC"},
+		}},
+		Default: "deny",
+	})
+	defer proc.Close()
+
+	now := at(t, "2026-01-05T16:59:00Z")
+	proc.Clock = func() time.Time { return now }
+	session := proc.NewSession()
+	now = at(t, "2026-01-05T17:30:00Z")
+	request := []byte("GET http://work.example/ HTTP/1.1\r\nHost: work.example\r\n\r\n")
+	if _, verdict := session.Process(request); verdict.Response != ALLOW {
+		t.Errorf("first request %s, expected allow", verdict)
+	}
+	if _, verdict := session.Process(request); verdict.Response != ALLOW {
+		t.Errorf("later request %s, expected allow", verdict)
+	}
+
+	if _, verdict := proc.NewSession().Process(request); verdict.Response == ALLOW {
+		t.Errorf("session started after hours was allowed")
+	}
+}
@@ -1,7 +1,7 @@
 package rules
 
 type Rule interface {
-	Allow(data []byte) RuleResponse
+	Allow(req *Request) Verdict
 }
 
 type RuleResponse string
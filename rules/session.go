@@ -0,0 +1,287 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxHeadSize = 64 * 1024
+
+// / A complete request head, parsed once and handed to every rule
+type Request struct {
+	Method string /// "" if the session isn't http at all
+	Target string /// host:port - the CONNECT authority, or the host of the request url
+	Head   []byte /// the raw head as it'll be forwarded, or the first bytes of a non http session
+	Sni    string /// from the tls client hello, if the session starts with one
+	Alpn   []string
+	Time   time.Time /// when the session started, for scheduled rules - now if zero
+}
+
+func ParseRequest(head []byte) (*Request, error) {
+	httpreq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, err
+	}
+	req := &Request{
+		Method: httpreq.Method,
+		Head:   head,
+	}
+	if httpreq.Method == http.MethodConnect {
+		req.Target = httpreq.RequestURI
+	} else {
+		req.Target = httpreq.Host
+		if _, _, err := net.SplitHostPort(req.Target); err != nil && req.Target != "" {
+			req.Target = net.JoinHostPort(req.Target, "80")
+		}
+	}
+	return req, nil
+}
+
+type sessionState int
+
+const (
+	stateHead       sessionState = iota /// buffering until a complete request head arrives
+	stateBody                           /// passing a Content-Length body through
+	stateChunked                        /// passing a chunked body through
+	stateTunnel                         /// CONNECT/upgrade allowed, or not http at all - everything passes untouched
+	stateInnerHello                     /// CONNECT allowed, waiting for the tls client hello inside it to check the sni
+)
+
+// / Tracks one south side stream so rules see each request exactly once - however it's split across
+// / reads, and including pipelined and keep-alive requests. Once a CONNECT is allowed the tunneled bytes
+// / flow through without being looked at again.
+type Session struct {
+	proc      *Processor
+	state     sessionState
+	buf       []byte
+	remaining int64 /// body bytes left in stateBody, or in the current chunk in stateChunked
+	chunk     chunkState
+	connect   string /// the CONNECT target as sent, lowercased, for checking the inner sni against
+	target    string /// the destination of the first request, before the address guard pins it
+	started   time.Time
+
+	OnDecision func(req *Request, verdict Verdict) /// optional - told about every request the rules decide on
+}
+
+func (p *Processor) NewSession() *Session {
+	return &Session{proc: p, started: p.Clock()}
+}
+
+var allowed = Verdict{Response: ALLOW}
+
+// / Where the session's first request was going, "" if it isn't http or hasn't sent a request yet
+func (s *Session) Target() string {
+	return s.target
+}
+
+// / Feed data read from the south. Returns the bytes that may go north and an ALLOW verdict, or whatever
+// / was allowed before a blocked request along with the verdict that blocked it.
+func (s *Session) Process(data []byte) (out []byte, verdict Verdict) {
+	if s.state == stateTunnel && len(s.buf) == 0 {
+		return data, allowed
+	}
+	if len(s.buf) > 0 || s.state == stateHead {
+		s.buf = append(s.buf, data...)
+		data = s.buf
+		s.buf = nil
+	}
+	for len(data) > 0 {
+		switch s.state {
+		case stateTunnel:
+			return append(out, data...), allowed
+		case stateBody:
+			n := int64(len(data))
+			if n > s.remaining {
+				n = s.remaining
+			}
+			out = append(out, data[:n]...)
+			data = data[n:]
+			s.remaining -= n
+			if s.remaining == 0 {
+				s.state = stateHead
+			}
+		case stateChunked:
+			n, done, err := s.chunk.advance(data)
+			if err != nil {
+				return out, Verdict{Response: DROPFLAT, Rule: "invalid-chunk"}
+			}
+			out = append(out, data[:n]...)
+			data = data[n:]
+			if done {
+				s.state = stateHead
+			}
+		case stateInnerHello:
+			hello, err := ParseClientHello(data)
+			if err == ErrIncomplete && len(data) <= maxHeadSize {
+				s.buf = append([]byte{}, data...)
+				return out, allowed
+			}
+			s.state = stateTunnel
+			servername := ""
+			if err == nil {
+				servername = hello.ServerName
+			}
+			if looksLikeTls(data) && !sniMatchesConnect(s.connect, servername) {
+				fmt.Println("Tls server name", servername, "does not match CONNECT", s.connect, err)
+				if s.proc.sni.Mismatch == SNIMISMATCHBLOCK {
+					verdict = s.proc.enforce(&Request{Target: s.connect, Head: data, Sni: servername}, Verdict{Response: DROPFLAT, Rule: "sni-mismatch"})
+					if verdict.Response != ALLOW {
+						return out, verdict
+					}
+				}
+			}
+		case stateHead:
+			if !looksLikeHttp(data) {
+				if s.proc.sni != nil && looksLikeTls(data) && len(data) <= maxHeadSize {
+					if _, err := ParseClientHello(data); err == ErrIncomplete {
+						s.buf = append([]byte{}, data...)
+						return out, allowed
+					}
+				}
+				return s.evaluateOpaque(out, data)
+			}
+			end := bytes.Index(data, []byte("\r\n\r\n"))
+			if end < 0 {
+				if len(data) > maxHeadSize {
+					fmt.Println("Request head too large, dropping")
+					return out, Verdict{Response: DROPFLAT, Rule: "head-too-large"}
+				}
+				s.buf = append([]byte{}, data...)
+				return out, allowed
+			}
+			head := data[:end+4]
+			data = data[end+4:]
+			req, err := ParseRequest(head)
+			if err != nil {
+				fmt.Println("Unable to parse request head ", err)
+				return out, Verdict{Response: DROPFLAT, Rule: "invalid-head"}
+			}
+			req.Time = s.started
+			if s.target == "" {
+				s.target = req.Target
+			}
+			target := req.Target /// as sent, before the address guard pins it
+			verdict = s.proc.Allow(req)
+			if verdict.Response == ALLOW {
+				if guarded := s.proc.Guard(req); guarded.Response != ALLOW {
+					verdict = guarded
+				}
+			}
+			if s.OnDecision != nil {
+				s.OnDecision(req, verdict)
+			}
+			if verdict.Response != ALLOW {
+				return out, verdict
+			}
+			out = append(out, req.Head...)
+			s.afterHead(req, target)
+		}
+	}
+	return out, allowed
+}
+
+// / First bytes of a stream that isn't http - rules may still have something to say (e.g. a tls
+// / client hello), after that it's just passed through
+func (s *Session) evaluateOpaque(out []byte, data []byte) ([]byte, Verdict) {
+	req := &Request{Head: data, Time: s.started}
+	verdict := s.proc.Allow(req)
+	if s.OnDecision != nil {
+		s.OnDecision(req, verdict)
+	}
+	if verdict.Response != ALLOW {
+		verdict.Reply = nil /// an http error means nothing to a client that isn't speaking http
+		return out, verdict
+	}
+	s.state = stateTunnel
+	return append(out, data...), allowed
+}
+
+// / Work out what follows the head we've just let through
+func (s *Session) afterHead(req *Request, target string) {
+	httpreq, _ := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.Head)))
+	switch {
+	case req.Method == http.MethodConnect && s.proc.sni != nil && s.proc.sni.Mismatch != "":
+		s.state = stateInnerHello
+		s.connect = strings.ToLower(target)
+	case req.Method == http.MethodConnect, httpreq.Header.Get("Upgrade") != "":
+		s.state = stateTunnel
+	case len(httpreq.TransferEncoding) > 0 && httpreq.TransferEncoding[0] == "chunked":
+		s.state = stateChunked
+		s.chunk = chunkState{}
+	case httpreq.ContentLength > 0:
+		s.state = stateBody
+		s.remaining = httpreq.ContentLength
+	default:
+		s.state = stateHead
+	}
+}
+
+// / Request heads start with a method - an upper case token followed by a space
+func looksLikeHttp(data []byte) bool {
+	for i, c := range data {
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' || i > 16 {
+			return false
+		}
+	}
+	return true /// not enough to tell yet
+}
+
+// / Walks a chunked body so we know where the next request head starts
+type chunkState struct {
+	line      []byte /// partial chunk size or trailer line
+	remaining int64  /// data bytes plus trailing crlf left in the current chunk
+	trailers  bool   /// seen the zero length chunk, now reading trailer lines
+}
+
+// / Consume as much of data as belongs to the body. Returns how many bytes that was and whether the
+// / body has ended.
+func (c *chunkState) advance(data []byte) (n int, done bool, err error) {
+	for n < len(data) {
+		if c.remaining > 0 {
+			take := int64(len(data) - n)
+			if take > c.remaining {
+				take = c.remaining
+			}
+			n += int(take)
+			c.remaining -= take
+			continue
+		}
+		eol := bytes.IndexByte(data[n:], '\n')
+		if eol < 0 {
+			c.line = append(c.line, data[n:]...)
+			if len(c.line) > maxHeadSize {
+				return n, false, fmt.Errorf("chunk line too long")
+			}
+			return len(data), false, nil
+		}
+		line := strings.TrimSpace(string(append(c.line, data[n:n+eol]...)))
+		c.line = nil
+		n += eol + 1
+		if c.trailers {
+			if line == "" {
+				return n, true, nil
+			}
+			continue
+		}
+		size, _, _ := strings.Cut(line, ";")
+		chunklen, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || chunklen < 0 {
+			return n, false, fmt.Errorf("invalid chunk size %q", line)
+		}
+		if chunklen == 0 {
+			c.trailers = true
+			continue
+		}
+		c.remaining = chunklen + 2
+	}
+	return n, false, nil
+}
@@ -0,0 +1,64 @@
+package rules
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	SNIMISMATCHFLAG  = "flag"
+	SNIMISMATCHBLOCK = "block"
+)
+
+type SniConfig struct {
+	Enabled  bool   /// apply the connect rules to the sni of sessions that aren't http - those without a readable sni get the Default
+	Port     int    /// port the sni is checked against, for Ports and WhitelistPorts - defaults to 443
+	Mismatch string /// when the tls sni inside a CONNECT doesn't match its host, or is missing - "" ignore, "flag" log it, "block" drop it
+}
+
+// / Applies the connect rules to raw tls sessions (no CONNECT), using the server name and alpn from
+// / the client hello
+type SniRules struct {
+	connect *ConnectRules
+	port    string
+}
+
+func NewSniRules(connect *ConnectRules, cfg *SniConfig) *SniRules {
+	port := cfg.Port
+	if port == 0 {
+		port = 443
+	}
+	return &SniRules{connect: connect, port: fmt.Sprint(port)}
+}
+
+func (s *SniRules) Allow(req *Request) Verdict {
+	if req.Method != "" {
+		return Verdict{Response: UNDEFINED}
+	}
+	hello, err := ParseClientHello(req.Head)
+	if err != nil {
+		fmt.Println("No readable tls client hello, applying the default ", err)
+		return s.connect.defaultVerdict("sni:unreadable-hello")
+	}
+	if hello.ServerName == "" {
+		return s.connect.defaultVerdict("sni:no-server-name")
+	}
+	req.Sni = hello.ServerName
+	req.Alpn = hello.Alpn
+	req.Target = net.JoinHostPort(hello.ServerName, s.port)
+	verdict := s.connect.evaluate(req.Target, hello.Alpn, req.Time)
+	verdict.Rule = "sni:" + verdict.Rule
+	return verdict
+}
+
+// / Compare the sni of the tls session inside a CONNECT tunnel with the host that was asked for - the
+// / host as the client sent it, not the address the guard pinned it to. Returns false on a mismatch,
+// / including a hello without an sni.
+func sniMatchesConnect(connect string, sni string) bool {
+	host, _, err := net.SplitHostPort(connect)
+	if err != nil || net.ParseIP(host) != nil {
+		return true /// nothing to compare against
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".") == sni
+}
@@ -0,0 +1,83 @@
+package rules
+
+import (
+	"fmt"
+	"hdnprxy/configs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// / What a rule decided, and which rule it was
+type Verdict struct {
+	Response RuleResponse
+	Rule     string     /// the rule entry that matched, "" if none did
+	Reply    *DenyReply /// for REPSONDFAIL - what to tell the client, nil to just close
+
+	WouldBlock RuleResponse /// in monitor mode - what the rule would have done, "" if it allowed it anyway
+}
+
+func (v Verdict) String() string {
+	if v.WouldBlock != "" {
+		return fmt.Sprint(v.Response, " (", v.Rule, ", would ", v.WouldBlock, ")")
+	}
+	if v.Rule == "" {
+		return string(v.Response)
+	}
+	return fmt.Sprint(v.Response, " (", v.Rule, ")")
+}
+
+// / The response sent to the client when a request is denied (as opposed to dropped)
+type DenyReply struct {
+	Status   int               /// 403 by default - 407 and 451 are the other usual choices
+	Headers  map[string]string /// extra headers, e.g. Proxy-Authenticate for a 407
+	Body     string            /// optional body, e.g. an html block page
+	BodyFile string            /// or read the body from this file
+
+	response []byte
+}
+
+var defaultDenyReply = newDenyReply(http.StatusForbidden)
+
+func newDenyReply(status int) *DenyReply {
+	d := &DenyReply{Status: status}
+	d.Expand()
+	return d
+}
+
+// / Load the body file and build the response once, rather than for every denied request
+func (d *DenyReply) Expand() {
+	if d.Status == 0 {
+		d.Status = http.StatusForbidden
+	}
+	if d.Status < 400 || d.Status > 599 {
+		log.Panicln("Deny reply status must be an error status", d.Status)
+	}
+	body := d.Body
+	if d.BodyFile != "" {
+		data, err := os.ReadFile(configs.Expand(d.BodyFile))
+		if err != nil {
+			log.Panicln("Unable to read deny reply body", err)
+		}
+		body = string(data)
+	}
+
+	headers := make([]string, 0, len(d.Headers))
+	for name, value := range d.Headers {
+		headers = append(headers, name+": "+value+"\r\n")
+	}
+	sort.Strings(headers)
+	if _, ok := d.Headers["Content-Type"]; !ok && body != "" {
+		headers = append(headers, "Content-Type: text/html; charset=utf-8\r\n")
+	}
+	d.response = []byte(fmt.Sprint("HTTP/1.1 ", d.Status, " ", http.StatusText(d.Status), "\r\n",
+		strings.Join(headers, ""),
+		"Content-Length: ", len(body), "\r\n",
+		"Connection: close\r\n\r\n", body))
+}
+
+func (d *DenyReply) Bytes() []byte {
+	return d.response
+}
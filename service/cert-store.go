@@ -0,0 +1,116 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/299m/util/util"
+	"hdnprxy/configs"
+	"log"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// / The server certificates every listener presents. They're loaded once, picked by the name the client
+// / asks for, and swapped as a set when the files change - so a renewed certificate is used without a
+// / restart, and a half written renewal keeps the old ones until it loads.
+type CertStore struct {
+	files []configs.CertificateConfig /// the first is the default, for clients asking for a name nothing else has
+	certs atomic.Pointer[[]*tls.Certificate]
+	done  chan struct{}
+}
+
+func NewCertStore(servercfg *configs.TlsConfig) *CertStore {
+	s := &CertStore{
+		files: append([]configs.CertificateConfig{{Cert: servercfg.Cert, Key: servercfg.Key}}, servercfg.Certificates...),
+		done:  make(chan struct{}),
+	}
+	certs, err := s.load()
+	util.CheckError(err)
+	s.certs.Store(&certs)
+	return s
+}
+
+func (s *CertStore) load() ([]*tls.Certificate, error) {
+	certs := make([]*tls.Certificate, 0, len(s.files))
+	for _, files := range s.files {
+		cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", files.Cert, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("%s: %v", files.Cert, err)
+			}
+		}
+		certs = append(certs, &cert)
+	}
+	for i, cert := range certs {
+		fmt.Println("Certificate", s.files[i].Cert, "for", cert.Leaf.DNSNames, "expires", cert.Leaf.NotAfter.Format(time.DateOnly))
+	}
+	return certs, nil
+}
+
+// / For tls.Config - the first certificate valid for the name the client asked for, or the default
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *s.certs.Load()
+	if hello.ServerName != "" {
+		for _, cert := range certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return certs[0], nil
+}
+
+func (s *CertStore) TlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: s.GetCertificate}
+}
+
+func (s *CertStore) modTimes() map[string]time.Time {
+	modtimes := make(map[string]time.Time)
+	for _, files := range s.files {
+		for _, file := range []string{files.Cert, files.Key} {
+			if info, err := os.Stat(file); err == nil {
+				modtimes[file] = info.ModTime()
+			}
+		}
+	}
+	return modtimes
+}
+
+// / Reload the certificates whenever their files change, checked every interval, until Stop
+func (s *CertStore) Watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		last := s.modTimes()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(interval):
+			}
+			current := s.modTimes()
+			if reflect.DeepEqual(last, current) {
+				continue
+			}
+			certs, err := s.load()
+			if err != nil {
+				log.Println("Keeping the current certificates, unable to load the new ones", err)
+				continue /// try again next time, the renewal may not have finished writing
+			}
+			s.certs.Store(&certs)
+			last = current
+			fmt.Println("Reloaded the certificates")
+		}
+	}()
+}
+
+func (s *CertStore) Stop() {
+	close(s.done)
+}
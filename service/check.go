@@ -0,0 +1,465 @@
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/299m/util/util"
+	"hdnprxy/configs"
+	"hdnprxy/proxy"
+	relay2 "hdnprxy/relay"
+	"hdnprxy/rules"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// / Collects every problem with a config directory, rather than stopping at the first like startup does
+type configChecker struct {
+	cfgpath  string
+	problems []string
+	current  string                     /// the file being checked, for messages
+	sections map[string]json.RawMessage /// when checking a single config file rather than a directory
+}
+
+func (c *configChecker) problem(field string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if field != "" {
+		msg = field + ": " + msg
+	}
+	if c.sections != nil {
+		c.problems = append(c.problems, filepath.Base(c.cfgpath)+": "+c.current+": "+msg)
+		return
+	}
+	c.problems = append(c.problems, c.current+".json: "+msg)
+}
+
+// / Decode a config file, strictly first so misspelt field names are reported, then leniently so the rest
+// / of the file can still be checked. Returns false if the file can't be used at all.
+func (c *configChecker) load(name string, cfg any) bool {
+	c.current = name
+	var data []byte
+	if c.sections != nil {
+		if data = c.sections[name]; data == nil {
+			c.problem("", "missing section")
+			return false
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(filepath.Join(c.cfgpath, name+".json")); err != nil {
+			c.problem("", "%v", err)
+			return false
+		}
+	}
+	strict := json.NewDecoder(bytes.NewReader(data))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(cfg); err != nil {
+		var syntaxerr *json.SyntaxError
+		if !strings.HasPrefix(err.Error(), "json: unknown field") {
+			if errors.As(err, &syntaxerr) {
+				line := bytes.Count(data[:syntaxerr.Offset], []byte("\n")) + 1
+				c.problem("", "invalid json on line %d: %v", line, err)
+			} else if errors.Is(err, io.ErrUnexpectedEOF) {
+				c.problem("", "invalid json: the file ends part way through, check for a missing } or ]")
+			} else {
+				c.problem("", "%v", decodeError(err))
+			}
+			return false
+		}
+		c.problem("", "%v", err)
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// / Run the file's own Expand, turning its panic into a problem - for anything the explicit checks missed
+func (c *configChecker) expand(cfg util.Expandable) {
+	before := len(c.problems)
+	defer func() {
+		if r := recover(); r != nil && len(c.problems) == before {
+			c.problem("", "%v", r)
+		}
+	}()
+	cfg.Expand()
+}
+
+// / Expand a value as loading will - a ${VAR:?} or secret that fails is a problem rather than a panic
+func (c *configChecker) expanded(field string, expand func() string) (value string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.problem(field, "%v", strings.TrimSpace(fmt.Sprint(r)))
+		}
+	}()
+	return expand(), true
+}
+
+func (c *configChecker) env(field string, value string) (string, bool) {
+	return c.expanded(field, func() string { return configs.Expand(value) })
+}
+
+func (c *configChecker) secret(field string, value string, what string) (string, bool) {
+	return c.expanded(field, func() string { return configs.ExpandSecret(value, what) })
+}
+
+// / Check a duration field, returning it if it's set and valid
+func (c *configChecker) duration(field string, value string, required bool) (time.Duration, bool) {
+	value, ok := c.env(field, value)
+	if !ok {
+		return 0, false
+	}
+	if value == "" {
+		if required {
+			c.problem(field, "missing, e.g. \"30s\"")
+		}
+		return 0, false
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		c.problem(field, "invalid duration %q, e.g. \"30s\" or \"5m\"", value)
+		return 0, false
+	}
+	return duration, true
+}
+
+func (c *configChecker) file(field string, path string) {
+	path, ok := c.env(field, path)
+	if !ok {
+		return
+	}
+	if path == "" {
+		c.problem(field, "missing")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		c.problem(field, "%v", err)
+	}
+}
+
+func (c *configChecker) checkGeneral(general *General) {
+	c.duration("Timeout", general.Timeout, true)
+	c.duration("ConfigPoll", general.ConfigPoll, false)
+	if general.ProxyBufferSizes < 0 {
+		c.problem("ProxyBufferSizes", "can't be negative")
+	}
+	for i, cert := range general.AllowedCACerts {
+		field := fmt.Sprint("AllowedCACerts[", i, "]")
+		path, ok := c.env(field, cert)
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			c.problem(field, "%v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			c.problem(field, "%s has no PEM certificates", cert)
+		}
+	}
+}
+
+func (c *configChecker) checkProxies(proxies *Proxies, islocal bool) {
+	seen := make(map[string]bool)
+	for key, proxycfg := range proxies.Proxies {
+		truekey, ok := c.secret("Proxies", key, "Proxy key")
+		if !ok {
+			continue
+		}
+		field := "Proxies[" + maskKey(truekey) + "]"
+		if seen[truekey] {
+			c.problem(field, "two proxy keys are the same once expanded")
+		}
+		seen[truekey] = true
+		if proxycfg.E2eSecret != "" {
+			c.secret(field+".E2eSecret", proxycfg.E2eSecret, "E2eSecret")
+		}
+		switch proxycfg.Type {
+		case CONNNET, CONNRAWTCP, CONNWEBSOCK, CONNNETTOWEBSOCK, CONNWEBSOCKNET:
+		default:
+			c.problem(field+".Type", "unknown proxy type %q, one of net, raw, ws, n-ws, s-ws", proxycfg.Type)
+		}
+		if proxycfg.Proxyendpoint == "" && len(proxycfg.Proxyendpoints) == 0 {
+			c.problem(field, "needs a Proxyendpoint or Proxyendpoints")
+		}
+		for _, endpoint := range proxycfg.Endpoints() {
+			if endpoint == "" {
+				continue
+			}
+			if expanded, ok := c.env(field+".Proxyendpoint", endpoint); !ok {
+				continue
+			} else if _, err := url.Parse(expanded); err != nil {
+				c.problem(field+".Proxyendpoint", "%v", err)
+			}
+		}
+		c.duration(field+".Timeout", proxycfg.Timeout, false)
+		if healthcheck, ok := c.duration(field+".Healthcheck", proxycfg.Healthcheck, false); ok && healthcheck <= 0 {
+			c.problem(field+".Healthcheck", "must be more than 0s")
+		}
+		if len(proxycfg.Routes) > 0 {
+			if _, err := NewUpstreamRouter(proxycfg.Routes, proxycfg.Endpoints()); err != nil {
+				c.problem(field+".Routes", "%v", err)
+			}
+		}
+	}
+	if _, ok := proxies.Proxies["tunnel"]; islocal && !ok {
+		c.problem("Proxies", "a local hdnprxy needs a \"tunnel\" entry pointing at the remote")
+	}
+}
+
+func (c *configChecker) checkConnectRules(conncfg *rules.ConnectConfig, field string) {
+	for i, pattern := range conncfg.Whitelist {
+		if _, err := regexp.Compile(pattern); err != nil {
+			c.problem(fmt.Sprint(field, "Whitelist[", i, "]"), "%v", err)
+		}
+	}
+	for i, pattern := range conncfg.Blacklist {
+		if _, err := regexp.Compile(pattern); err != nil {
+			c.problem(fmt.Sprint(field, "Blacklist[", i, "]"), "%v", err)
+		}
+	}
+	for i, entry := range conncfg.Rules {
+		entryfield := fmt.Sprint(field, "Rules[", i, "]")
+		if _, err := rules.ParseAction(entry.Action); err != nil {
+			c.problem(entryfield+".Action", "%v", err)
+		}
+		if _, err := rules.NewDestinationMatcher(entry.Hosts, entry.Ports, entry.Cidrs); err != nil {
+			c.problem(entryfield, "%v", err)
+		}
+		if entry.Schedule != nil {
+			if _, err := rules.NewSchedule(entry.Schedule); err != nil {
+				c.problem(entryfield+".Schedule", "%v", err)
+			}
+		}
+		if entry.Reply != nil && entry.Reply.BodyFile != "" {
+			c.file(entryfield+".Reply.BodyFile", entry.Reply.BodyFile)
+		}
+	}
+	for i, list := range conncfg.Blocklists {
+		listfield := fmt.Sprint(field, "Blocklists[", i, "]")
+		c.file(listfield+".File", list.File)
+		c.duration(listfield+".Refresh", list.Refresh, false)
+	}
+	if conncfg.Default != "" {
+		if _, err := rules.ParseAction(conncfg.Default); err != nil {
+			c.problem(field+"Default", "%v", err)
+		}
+	}
+	if conncfg.DenyReply != nil && conncfg.DenyReply.BodyFile != "" {
+		c.file(field+"DenyReply.BodyFile", conncfg.DenyReply.BodyFile)
+	}
+	c.duration(field+"MonitorSummary", conncfg.MonitorSummary, false)
+	for name, setcfg := range conncfg.RuleSets {
+		c.checkConnectRules(setcfg, field+"RuleSets["+name+"].")
+	}
+}
+
+func (c *configChecker) checkTls(servercfg *configs.TlsConfig) {
+	modes := 0
+	for _, set := range []bool{servercfg.IsHttps, servercfg.IsProxy, servercfg.IsTlsProxy, servercfg.IsTcpProxy} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		c.problem("", "exactly one of IsHttps, IsProxy, IsTlsProxy or IsTcpProxy must be set, %d are", modes)
+	}
+	if expanded, ok := c.env("Port", servercfg.Port); ok {
+		port, err := strconv.Atoi(expanded)
+		if err != nil || port <= 0 || port > 65535 {
+			c.problem("Port", "invalid port %q", servercfg.Port)
+		}
+	}
+	if servercfg.IsTcpProxy {
+		return /// the only mode that doesn't use the certificate
+	}
+	c.duration("CertPoll", servercfg.CertPoll, false)
+	c.certificate("", servercfg.Cert, servercfg.Key)
+	for i, cert := range servercfg.Certificates {
+		c.certificate(fmt.Sprint("Certificates[", i, "]."), cert.Cert, cert.Key)
+	}
+}
+
+func (c *configChecker) certificate(field string, cert string, key string) {
+	before := len(c.problems)
+	c.file(field+"Cert", cert)
+	c.file(field+"Key", key)
+	if len(c.problems) > before {
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(configs.Expand(cert), configs.Expand(key)); err != nil {
+		c.problem(field+"Cert", "certificate and key don't load as a pair: %v", err)
+	}
+}
+
+func (c *configChecker) checkTunnel(tunnel *Tunnel, islocal bool, conncfg *rules.ConnectConfig) {
+	if islocal && (tunnel.Paramname == "" || tunnel.Paramval == "") {
+		c.problem("Paramname", "a local hdnprxy needs Paramname and Paramval to open the tunnel")
+	}
+	if tunnel.Paramval != "" {
+		c.secret("Paramval", tunnel.Paramval, "Tunnel Paramval")
+	}
+	if tunnel.E2e && tunnel.E2eSecret == "" {
+		c.problem("E2eSecret", "needed with E2e - Paramval is sent in the tunnel request, so the front could read it")
+	} else if tunnel.E2e {
+		secret, ok := c.secret("E2eSecret", tunnel.E2eSecret, "Tunnel E2eSecret")
+		paramval := func() string {
+			defer func() { recover() }() /// already reported above
+			return configs.ExpandSecret(tunnel.Paramval, "Tunnel Paramval")
+		}()
+		if ok && secret == paramval {
+			c.problem("E2eSecret", "can't be the same as Paramval, which is sent in the tunnel request")
+		}
+	}
+	if tunnel.Transport != "" && tunnel.Transport != relay2.POLLTRANSPORT {
+		c.problem("Transport", "unknown transport %q, leave it out or use %q", tunnel.Transport, relay2.POLLTRANSPORT)
+	}
+	c.duration("RetryBudget", tunnel.RetryBudget, false)
+	c.duration("RetryBackoff", tunnel.RetryBackoff, false)
+	if tunnel.Shaping != nil {
+		if err := tunnel.Shaping.Validate(); err != nil {
+			c.problem("Shaping", "%v", err)
+		}
+	}
+	if tunnel.Split != nil {
+		if _, err := NewSplitRouter(tunnel.Split); err != nil {
+			c.problem("Split", "%v", err)
+		}
+	}
+	if tunnel.Pac != nil {
+		if tunnel.Pac.Listen == "" {
+			c.problem("Pac.Listen", "missing, e.g. \"127.0.0.1:20480\"")
+		}
+		if _, err := GeneratePac(tunnel.Pac, tunnel.Split, conncfg, "0", false); err != nil {
+			c.problem("Pac", "%v", err)
+		}
+	}
+}
+
+// / Check every file in a config directory. Returns the problems found, empty if it's good to go.
+func CheckConfig(cfgpath string) []string {
+	/// problems are collected from the log.Panicln that loading would stop with - don't log them as well
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	c := &configChecker{cfgpath: cfgpath}
+	before := func() int { return len(c.problems) }
+	if isConfigFile(cfgpath) {
+		sections, err := readConfigSections(cfgpath)
+		if err != nil {
+			return []string{filepath.Base(cfgpath) + ": " + err.Error()}
+		}
+		c.sections = sections
+		for name := range sections {
+			if !slices.Contains(configSections, name) {
+				c.current = name
+				c.problem("", "unknown section, expected one of %s", strings.Join(configSections, ", "))
+			}
+		}
+	}
+
+	servercfg := &configs.TlsConfig{}
+	if c.load("tls", servercfg) {
+		n := before()
+		c.checkTls(servercfg)
+		if before() == n {
+			c.expand(servercfg)
+		}
+	}
+
+	general := &General{}
+	if c.load("general", general) {
+		n := before()
+		c.checkGeneral(general)
+		if before() == n {
+			c.expand(general)
+		}
+	}
+	islocal := general.IsLocal /// as NewService decides which side this is
+
+	content := &Content{}
+	if c.load("content", content) {
+		c.expand(content)
+	}
+
+	engine := &proxy.Config{}
+	if c.load("engine", engine) {
+		c.expand(engine)
+	}
+
+	proxies := &Proxies{}
+	proxiesok := c.load("proxies", proxies)
+	if proxiesok {
+		n := before()
+		c.checkProxies(proxies, islocal)
+		if before() == n {
+			c.expand(proxies)
+		}
+	}
+
+	conncfg := &rules.ConnectConfig{}
+	if c.load("connect-rules", conncfg) {
+		n := before()
+		c.checkConnectRules(conncfg, "")
+		if before() == n {
+			c.current = "connect-rules"
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						c.problem("", "%v", r)
+					}
+				}()
+				conncfg.Audit = nil /// checking shouldn't create the audit logs
+				for _, setcfg := range conncfg.RuleSets {
+					setcfg.Audit = nil
+				}
+				sets := rules.NewRuleSets(conncfg)
+				defer sets.Close()
+				if proxiesok {
+					if err := checkRuleSets(proxies, sets); err != nil {
+						c.current = "proxies"
+						c.problem("RuleSet", "%v", err)
+					}
+				}
+			}()
+		}
+	}
+
+	tunnel := &Tunnel{}
+	if c.load("tunnel", tunnel) {
+		n := before()
+		c.checkTunnel(tunnel, islocal, conncfg)
+		if before() == n {
+			c.expand(tunnel)
+		}
+	}
+	return c.problems
+}
+
+// / hdnprxy check --config <dir> - prints every problem found, exits with 1 if there were any
+func RunCheck(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	cfgpath := flags.String("config", "", "Path to the configuration file(s)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	problems := CheckConfig(*cfgpath)
+	for _, problem := range problems {
+		fmt.Fprintln(stdout, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintln(stdout, len(problems), "problems in", *cfgpath)
+		return 1
+	}
+	fmt.Fprintln(stdout, *cfgpath, "looks good")
+	return 0
+}
@@ -0,0 +1,294 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/299m/util/util"
+	"gopkg.in/yaml.v3"
+	"hdnprxy/configs"
+	"hdnprxy/proxy"
+	"hdnprxy/rules"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// / The config sections, in the order a single config file is written - each is also a <name>.json in a
+// / config directory
+var configSections = []string{"content", "general", "engine", "proxies", "connect-rules", "tls", "tunnel"}
+
+// / What each section decodes into, so a yaml scalar can be read the way its field wants it
+var sectionTypes = map[string]reflect.Type{
+	"content":       reflect.TypeOf(Content{}),
+	"general":       reflect.TypeOf(General{}),
+	"engine":        reflect.TypeOf(proxy.Config{}),
+	"proxies":       reflect.TypeOf(Proxies{}),
+	"connect-rules": reflect.TypeOf(rules.ConnectConfig{}),
+	"tls":           reflect.TypeOf(configs.TlsConfig{}),
+	"tunnel":        reflect.TypeOf(Tunnel{}),
+}
+
+// / --config can be a directory of json files or a single yaml or json file with a section for each
+func isConfigFile(cfgpath string) bool {
+	info, err := os.Stat(cfgpath)
+	return err == nil && !info.IsDir()
+}
+
+func isYaml(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// / yaml decodes mappings with non-string keys as map[any]any, which json can't encode
+func jsonCompatible(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonCompatible(item)
+		}
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return converted
+	case []any:
+		for i, item := range v {
+			v[i] = jsonCompatible(item)
+		}
+	}
+	return value
+}
+
+// / The field json would decode key into - by its json tag or name, ignoring case, as encoding/json does
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if inner, ok := jsonField(embedded, key); ok {
+					return inner, true
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// / yaml reads Port: 443 or Enabled: yes as a number or bool, which json then won't put in a string
+// / field. Mark any scalar headed for a string field as a string, keeping it as it was written.
+func stringScalars(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!int", "!!float", "!!bool":
+			if t.Kind() == reflect.String {
+				node.Tag = "!!str"
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			for _, item := range node.Content {
+				stringScalars(item, t.Elem())
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			switch t.Kind() {
+			case reflect.Map:
+				stringScalars(node.Content[i+1], t.Elem())
+			case reflect.Struct:
+				if field, ok := jsonField(t, node.Content[i].Value); ok {
+					stringScalars(node.Content[i+1], field.Type)
+				}
+			}
+		}
+	}
+}
+
+// / A decode error with the key it was for - json's own leaves out where in the file it was
+func decodeError(err error) error {
+	var typeerr *json.UnmarshalTypeError
+	if !errors.As(err, &typeerr) || typeerr.Field == "" {
+		return err
+	}
+	hint := ""
+	if typeerr.Type.Kind() == reflect.String {
+		hint = ", quote it"
+	}
+	return fmt.Errorf("%s: expected %s, not a %s%s", typeerr.Field, typeerr.Type, typeerr.Value, hint)
+}
+
+// / Split a single config file into its sections, each as json so the same types can decode it
+func readConfigSections(path string) (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sections := make(map[string]json.RawMessage)
+	if !isYaml(path) {
+		if err := json.Unmarshal(data, &sections); err != nil {
+			var syntaxerr *json.SyntaxError
+			if errors.As(err, &syntaxerr) {
+				return nil, fmt.Errorf("invalid json on line %d: %v", bytes.Count(data[:syntaxerr.Offset], []byte("\n"))+1, err)
+			}
+			return nil, err
+		}
+		return sections, nil
+	}
+	document := make(map[string]yaml.Node)
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	for name, node := range document {
+		if t, ok := sectionTypes[name]; ok {
+			stringScalars(&node, t)
+		}
+		var section any
+		if err := node.Decode(&section); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if sections[name], err = json.Marshal(jsonCompatible(section)); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return sections, nil
+}
+
+// / util.ReadConfig, but also taking a single config file
+func readConfig(cfgpath string, cfg map[string]util.Expandable) {
+	if !isConfigFile(cfgpath) {
+		util.ReadConfig(cfgpath, cfg)
+		return
+	}
+	sections, err := readConfigSections(cfgpath)
+	util.CheckError(err)
+	for name, something := range cfg {
+		section, ok := sections[name]
+		if !ok {
+			log.Panicln("No", name, "section in", cfgpath)
+		}
+		if err := json.Unmarshal(section, something); err != nil {
+			log.Panicln("Section", name+":", decodeError(err))
+		}
+		something.Expand()
+	}
+}
+
+// / Switch a node parsed from json over to yaml's plain block style. Strings keep their !!str tag, so the
+// / encoder still quotes any like "443" that would otherwise read back as something else.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// / Combine a config directory into a single yaml or json file. The files are copied as they are -
+// / environment variables are left for loading to expand.
+func ConvertConfig(cfgdir string, toyaml bool) ([]byte, error) {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	var combined bytes.Buffer
+	combined.WriteString("{")
+	for _, name := range configSections {
+		data, err := os.ReadFile(filepath.Join(cfgdir, name+".json"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue /// not every side uses every file
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !json.Valid(data) {
+			return nil, fmt.Errorf("%s.json isn't valid json, hdnprxy check will say where", name)
+		}
+		if !toyaml {
+			if combined.Len() > 1 {
+				combined.WriteString(",")
+			}
+			fmt.Fprintf(&combined, "%q:%s", name, data)
+			continue
+		}
+		section := &yaml.Node{}
+		if err := yaml.Unmarshal(data, section); err != nil {
+			return nil, fmt.Errorf("%s.json: %v", name, err)
+		}
+		blockStyle(section)
+		document.Content = append(document.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, section.Content[0])
+	}
+	combined.WriteString("}")
+	if !toyaml {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, combined.Bytes(), "", "  "); err != nil {
+			return nil, err
+		}
+		indented.WriteString("\n")
+		return indented.Bytes(), nil
+	}
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// / hdnprxy convert --config <dir> [--out file.yaml|file.json] - the yaml goes to stdout without --out
+func RunConvert(args []string, stdout io.Writer) int {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	cfgpath := flags.String("config", "", "Path to the configuration directory")
+	out := flags.String("out", "", "File to write, yaml unless it ends in .json - it mustn't already exist")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *cfgpath == "" || isConfigFile(*cfgpath) {
+		fmt.Fprintln(stdout, "--config must be a config directory")
+		return 2
+	}
+	converted, err := ConvertConfig(*cfgpath, strings.ToLower(filepath.Ext(*out)) != ".json")
+	if err != nil {
+		fmt.Fprintln(stdout, "Unable to convert", *cfgpath, err)
+		return 1
+	}
+	if *out == "" {
+		stdout.Write(converted)
+		return 0
+	}
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600) /// it may well hold keys
+	if err == nil {
+		_, err = file.Write(converted)
+		if closeerr := file.Close(); err == nil {
+			err = closeerr
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stdout, "Unable to write", *out, err)
+		return 1
+	}
+	fmt.Fprintln(stdout, "Wrote", *out, "- start with hdnprxy --config", *out)
+	return 0
+}
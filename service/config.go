@@ -1,8 +1,12 @@
 package service
 
 import (
-	"os"
+	"github.com/299m/util/util"
+	"hdnprxy/configs"
+	relay2 "hdnprxy/relay"
+	"log"
 	"strings"
+	"time"
 )
 
 type Content struct {
@@ -12,9 +16,9 @@ type Content struct {
 }
 
 func (c *Content) Expand() {
-	c.Basedir = os.ExpandEnv(c.Basedir)
-	c.Homefile = os.ExpandEnv(c.Homefile)
-	c.Downloaddir = os.ExpandEnv(c.Downloaddir)
+	c.Basedir = configs.Expand(c.Basedir)
+	c.Homefile = configs.Expand(c.Homefile)
+	c.Downloaddir = configs.Expand(c.Downloaddir)
 	if c.Downloaddir == "" {
 		c.Downloaddir = "downloads"
 	}
@@ -22,9 +26,24 @@ func (c *Content) Expand() {
 
 // Key - if key is 123 and we see /123/ then we will proxy the request to the proxyendpoint
 type ProxyContent struct {
-	Proxyendpoint string
-	Type          string // currently "ws", "net", "raw", "n-ws" (websock north), "s-ws" (websock south), may try to support http in the future
-	Timeout       string
+	Proxyendpoint  string
+	Proxyendpoints []string // optional, on the local side - remotes to fail over between, in order of preference
+	Healthcheck    string   // how often to health check Proxyendpoints, defaults to 30s
+	healthcheck    time.Duration
+	E2eSecret      string       // optional, on the remote side - the shared secret for tunnels asking for E2e, never sent over the wire. E2e is refused without it
+	RuleSet        string       // optional, on the remote side - a named rule set from connect-rules.json RuleSets, instead of the global rules
+	Routes         []RouteEntry // optional, on the remote side - pick the upstream by destination, anything unmatched goes to Proxyendpoint(s)
+	router         *UpstreamRouter
+	Type           string // currently "ws", "net", "raw", "n-ws" (websock north), "s-ws" (websock south), may try to support http in the future
+	Timeout        string
+}
+
+// / Every endpoint for this proxy, in order of preference
+func (p *ProxyContent) Endpoints() []string {
+	if len(p.Proxyendpoints) > 0 {
+		return p.Proxyendpoints
+	}
+	return []string{p.Proxyendpoint}
 }
 
 type General struct {
@@ -34,15 +53,16 @@ type General struct {
 	ProxyBufferSizes int
 	AllowedCACerts   []string
 	Debuglogs        bool
+	ConfigPoll       string /// how often to check proxies.json and connect-rules.json for changes, defaults to 5s, 0s for SIGHUP only
 
 	IsLocal bool //// Set this if this is the local side of a tunnel
 
 }
 
 func (g *General) Expand() {
-	g.ProxyParam = os.ExpandEnv(g.ProxyParam)
-	g.ProxyRoute = os.ExpandEnv(g.ProxyRoute)
-	g.Timeout = os.ExpandEnv(g.Timeout)
+	g.ProxyParam = configs.Expand(g.ProxyParam)
+	g.ProxyRoute = configs.Expand(g.ProxyRoute)
+	g.Timeout = configs.Expand(g.Timeout)
 
 	//// Do any other expansion above this
 	if len(g.AllowedCACerts) == 1 && strings.Contains(g.AllowedCACerts[0], ",") {
@@ -50,7 +70,7 @@ func (g *General) Expand() {
 		return
 	}
 	for i, cert := range g.AllowedCACerts {
-		g.AllowedCACerts[i] = os.ExpandEnv(cert)
+		g.AllowedCACerts[i] = configs.Expand(cert)
 	}
 }
 
@@ -62,9 +82,38 @@ func (p *Proxies) Expand() {
 	//shallow copy the map first - otherwise we're iterating and changing it at the same time
 	proxies := make(map[string]*ProxyContent)
 	for key, proxy := range p.Proxies {
-		truekey := os.ExpandEnv(key)
-		proxy.Proxyendpoint = os.ExpandEnv(proxy.Proxyendpoint)
-		proxy.Timeout = os.ExpandEnv(proxy.Timeout)
+		truekey := configs.ExpandSecret(key, "Proxy key")
+		if proxy.E2eSecret != "" {
+			proxy.E2eSecret = configs.ExpandSecret(proxy.E2eSecret, "E2eSecret")
+		}
+		if _, ok := proxies[truekey]; ok {
+			log.Panicln("Two proxy keys are", maskKey(truekey), "once expanded")
+		}
+		proxy.Proxyendpoint = configs.Expand(proxy.Proxyendpoint)
+		for i, endpoint := range proxy.Proxyendpoints {
+			proxy.Proxyendpoints[i] = configs.Expand(endpoint)
+		}
+		proxy.Healthcheck = configs.Expand(proxy.Healthcheck)
+		proxy.healthcheck = 30 * time.Second
+		if proxy.Healthcheck != "" {
+			var err error
+			proxy.healthcheck, err = time.ParseDuration(proxy.Healthcheck)
+			util.CheckError(err)
+			if proxy.healthcheck <= 0 {
+				log.Panicln("Healthcheck must be more than 0s, got", proxy.Healthcheck)
+			}
+		}
+		proxy.Timeout = configs.Expand(proxy.Timeout)
+		if len(proxy.Routes) > 0 {
+			for _, route := range proxy.Routes {
+				for i, upstream := range route.Upstreams {
+					route.Upstreams[i] = configs.Expand(upstream)
+				}
+			}
+			var err error
+			proxy.router, err = NewUpstreamRouter(proxy.Routes, proxy.Endpoints())
+			util.CheckError(err)
+		}
 		proxies[truekey] = proxy
 	}
 	p.Proxies = proxies
@@ -73,9 +122,59 @@ func (p *Proxies) Expand() {
 type Tunnel struct {
 	Paramname string //// These are the triggers to start the tunnel on the config side
 	Paramval  string
+	Transport string //// "" for a hijacked http stream, "poll" for http long polling through hostile middleboxes
+
+	Shaping   *relay2.ShapingConfig //// optional - pad records and add cover traffic, the remote follows these settings
+	E2e       bool                  //// encrypt inside the tunnel, for remotes behind a tls terminating front
+	E2eSecret string                //// required with E2e - the shared secret, which unlike Paramval is never sent. Must match the remote proxy key's E2eSecret
+
+	Split *SplitConfig //// optional - send some destinations direct, or reject them, instead of tunneling everything
+	Pac   *PacConfig   //// optional - serve a proxy auto-config file for this local proxy
+
+	RetryBudget  string //// keep retrying tunnel setup for this long, defaults to 15s
+	RetryBackoff string //// first wait between retries, doubled each time, defaults to 250ms
+
+	retrybudget  time.Duration
+	retrybackoff time.Duration
+	split        *SplitRouter
 }
 
 func (t *Tunnel) Expand() {
-	t.Paramval = os.ExpandEnv(t.Paramval)
-	t.Paramname = os.ExpandEnv(t.Paramname)
+	if t.Paramval != "" {
+		t.Paramval = configs.ExpandSecret(t.Paramval, "Tunnel Paramval")
+	}
+	if t.E2e {
+		if t.E2eSecret == "" {
+			log.Panicln("E2e needs an E2eSecret - Paramval is sent in the tunnel request, so the front could read it")
+		}
+		t.E2eSecret = configs.ExpandSecret(t.E2eSecret, "Tunnel E2eSecret")
+		if t.E2eSecret == t.Paramval {
+			log.Panicln("E2eSecret can't be the same as Paramval, which is sent in the tunnel request")
+		}
+	}
+	t.Paramname = configs.Expand(t.Paramname)
+	t.Transport = configs.Expand(t.Transport)
+	t.retrybudget = 15 * time.Second
+	if t.RetryBudget != "" {
+		var err error
+		t.retrybudget, err = time.ParseDuration(t.RetryBudget)
+		util.CheckError(err)
+	}
+	t.retrybackoff = 250 * time.Millisecond
+	if t.RetryBackoff != "" {
+		var err error
+		t.retrybackoff, err = time.ParseDuration(t.RetryBackoff)
+		util.CheckError(err)
+		if t.retrybackoff <= 0 {
+			log.Panicln("Tunnel RetryBackoff must be more than 0", t.RetryBackoff)
+		}
+	}
+	if t.Shaping != nil {
+		util.CheckError(t.Shaping.Validate())
+	}
+	if t.Split != nil {
+		var err error
+		t.split, err = NewSplitRouter(t.Split)
+		util.CheckError(err)
+	}
 }
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"fmt"
+	"hdnprxy/rules"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// / Serve a proxy auto-config file so the system can be pointed at one url instead of a manual proxy.
+// / What goes to the proxy follows connect-rules.json - anything it won't allow goes DIRECT.
+type PacConfig struct {
+	Listen    string /// where to serve it, e.g. "127.0.0.1:20480" - the file is at /proxy.pac and /wpad.dat
+	ProxyHost string /// how clients reach this proxy, defaults to 127.0.0.1
+}
+
+// / One rule as the pac file's javascript sees it
+type pacRule struct {
+	Proxy     bool       `json:"proxy"`
+	Exact     []string   `json:"exact"`
+	Suffixes  []string   `json:"suffixes"`
+	Regexes   []string   `json:"regexes"`   /// matched against the host, ignoring case
+	HostPorts []string   `json:"hostports"` /// the old Whitelist/Blacklist regexes, matched against host:port
+	Ports     [][2]int   `json:"ports"`
+	Cidrs     [][]string `json:"cidrs"`
+	Resolve   bool       `json:"resolve"` /// look names matching resolvable up so the cidrs can match them
+	Never     bool       `json:"never"`   /// everything it had was left out (ipv6 cidrs), it mustn't become match-all
+}
+
+// / The connect rules as the pac file's javascript sees them - the first rule to match decides, as in
+// / rules.ConnectRules, and otherwise says whether the default lets a destination through
+type pacConnect struct {
+	Ports     [][2]int   `json:"ports"`
+	Rules     []*pacRule `json:"rules"`
+	Otherwise bool       `json:"otherwise"`
+}
+
+// / A Go regexp as a javascript RegExp source. They share most of their syntax - this refuses what
+// / javascript doesn't have, or would read differently, rather than let the pac file guess.
+func jsRegex(expr string) (string, error) {
+	if _, err := regexp.Compile(expr); err != nil {
+		return "", err
+	}
+	for i := 0; i < len(expr); i++ {
+		switch {
+		case expr[i] == '\\' && i+1 < len(expr):
+			i++
+			if strings.IndexByte("AzQEpP", expr[i]) >= 0 || strings.HasPrefix(expr[i:], "x{") {
+				return "", fmt.Errorf("%s: \\%c has no javascript equivalent for the pac file", expr, expr[i])
+			}
+		case strings.HasPrefix(expr[i:], "(?") && !strings.HasPrefix(expr[i:], "(?:"):
+			return "", fmt.Errorf("%s: flags and named groups have no javascript equivalent for the pac file", expr)
+		case strings.HasPrefix(expr[i:], "[[:"):
+			return "", fmt.Errorf("%s: character classes like [[:alpha:]] have no javascript equivalent for the pac file", expr)
+		}
+	}
+	return expr, nil
+}
+
+func newPacRule(proxy bool, hosts []string, ports []string, cidrs []string) (*pacRule, error) {
+	rule := &pacRule{Proxy: proxy, Exact: []string{}, Suffixes: []string{}, Regexes: []string{}, HostPorts: []string{}, Ports: [][2]int{}, Cidrs: [][]string{}}
+	for _, pattern := range hosts {
+		pattern = strings.TrimSpace(pattern)
+		if expr, ok := strings.CutPrefix(pattern, "re:"); ok {
+			/// hosts already match ignoring case, as rules.NewHostMatcher does
+			expr, err := jsRegex(strings.TrimPrefix(expr, "(?i)"))
+			if err != nil {
+				return nil, err
+			}
+			rule.Regexes = append(rule.Regexes, expr)
+			continue
+		}
+		pattern = strings.ToLower(pattern)
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			rule.Suffixes = append(rule.Suffixes, pattern[1:])
+		case strings.HasPrefix(pattern, "."):
+			rule.Suffixes = append(rule.Suffixes, pattern)
+		default:
+			rule.Exact = append(rule.Exact, pattern)
+		}
+	}
+	var err error
+	if rule.Ports, err = pacPorts(ports); err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			cidr += "/32" /// a bare ipv6 address parses too, and is skipped below
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet.IP.To4() == nil {
+			continue /// isInNet only understands ipv4
+		}
+		rule.Cidrs = append(rule.Cidrs, []string{ipnet.IP.String(), net.IP(ipnet.Mask).String()})
+	}
+	rule.Never = len(hosts)+len(cidrs) > 0 && len(rule.Exact)+len(rule.Suffixes)+len(rule.Regexes)+len(rule.Cidrs) == 0
+	return rule, nil
+}
+
+func pacPorts(specs []string) ([][2]int, error) {
+	ports := [][2]int{}
+	for _, spec := range specs {
+		var low, high int
+		if _, err := fmt.Sscanf(spec, "%d-%d", &low, &high); err != nil {
+			if _, err := fmt.Sscanf(spec, "%d", &low); err != nil {
+				return nil, fmt.Errorf("invalid port %s", spec)
+			}
+			high = low
+		}
+		ports = append(ports, [2]int{low, high})
+	}
+	return ports, nil
+}
+
+// / connect-rules.json for the pac file, nil if everything goes to the proxy. Entries that depend on
+// / more than the destination - a Schedule, Alpn - and the Blocklists are left for the proxy to decide.
+func newPacConnect(conncfg *rules.ConnectConfig) (*pacConnect, error) {
+	if conncfg == nil || strings.ToLower(conncfg.Mode) == rules.MODEMONITOR {
+		return nil, nil /// monitor mode lets everything through
+	}
+	connect := &pacConnect{Ports: [][2]int{}, Rules: []*pacRule{}}
+	for _, port := range conncfg.WhitelistPorts {
+		connect.Ports = append(connect.Ports, [2]int{port, port})
+	}
+	for i, entry := range conncfg.Rules {
+		action, err := rules.ParseAction(entry.Action)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		proxy := action == rules.ALLOW || entry.Schedule != nil || len(entry.Alpn) > 0
+		rule, err := newPacRule(proxy, entry.Hosts, entry.Ports, entry.Cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i, err)
+		}
+		connect.Rules = append(connect.Rules, rule)
+	}
+	for _, patterns := range []struct {
+		list  []string
+		proxy bool
+	}{{conncfg.Blacklist, false}, {conncfg.Whitelist, true}} {
+		for _, pattern := range patterns.list {
+			expr, err := jsRegex(pattern)
+			if err != nil {
+				return nil, err
+			}
+			rule, _ := newPacRule(patterns.proxy, nil, nil, nil)
+			rule.HostPorts = append(rule.HostPorts, expr)
+			connect.Rules = append(connect.Rules, rule)
+		}
+	}
+	if conncfg.Default != "" {
+		action, err := rules.ParseAction(conncfg.Default)
+		if err != nil {
+			return nil, err
+		}
+		connect.Otherwise = action == rules.ALLOW
+	}
+	return connect, nil
+}
+
+const pacTemplate = `// generated by hdnprxy
+var proxy = %s;
+var rules = %s;
+var connect = %s;
+var otherwise = %s;
+var resolvable = %s;
+
+function portOf(url) {
+    var m = url.match(/^[a-zA-Z]+:\/\/(?:[^\/@]*@)?(?:\[[^\]]*\]|[^\/:]*):(\d+)/);
+    if (m) return parseInt(m[1], 10);
+    return url.substring(0, 6).toLowerCase() == "https:" ? 443 : 80;
+}
+
+function inPorts(ports, port) {
+    for (var i = 0; i < ports.length; i++) {
+        if (port >= ports[i][0] && port <= ports[i][1]) return true;
+    }
+    return false;
+}
+
+function matches(rule, host, port) {
+    if (rule.never) return false;
+    if (rule.ports.length > 0 && !inPorts(rule.ports, port)) return false;
+    if (rule.exact.length == 0 && rule.suffixes.length == 0 && rule.regexes.length == 0 && rule.hostports.length == 0 && rule.cidrs.length == 0) return true;
+    for (var i = 0; i < rule.exact.length; i++) {
+        if (host == rule.exact[i]) return true;
+    }
+    for (var i = 0; i < rule.suffixes.length; i++) {
+        if (dnsDomainIs(host, rule.suffixes[i])) return true;
+    }
+    for (var i = 0; i < rule.regexes.length; i++) {
+        if (new RegExp(rule.regexes[i], "i").test(host)) return true;
+    }
+    for (var i = 0; i < rule.hostports.length; i++) {
+        if (new RegExp(rule.hostports[i]).test(host + ":" + port)) return true;
+    }
+    var literal = /^\d+\.\d+\.\d+\.\d+$/.test(host);
+    if (rule.cidrs.length > 0 && (literal || (rule.resolve && resolvable && matches(resolvable, host, port)))) {
+        var addr = literal ? host : dnsResolve(host);
+        for (var i = 0; addr && i < rule.cidrs.length; i++) {
+            if (isInNet(addr, rule.cidrs[i][0], rule.cidrs[i][1])) return true;
+        }
+    }
+    return false;
+}
+
+function allowed(host, port) {
+    if (!connect) return true;
+    if (connect.ports.length > 0 && !inPorts(connect.ports, port)) return false;
+    for (var i = 0; i < connect.rules.length; i++) {
+        if (matches(connect.rules[i], host, port)) return connect.rules[i].proxy;
+    }
+    return connect.otherwise;
+}
+
+function FindProxyForURL(url, host) {
+    host = host.toLowerCase();
+    var port = portOf(url);
+    for (var i = 0; i < rules.length; i++) {
+        if (matches(rules[i], host, port)) return rules[i].proxy ? proxy : "DIRECT";
+    }
+    if (!allowed(host, port)) return "DIRECT";
+    return otherwise;
+}
+`
+
+// / The pac file for this local proxy - split tunnel rules first, then what connect-rules.json allows,
+// / then the split tunnel default. Rejected destinations still go to the proxy so it can refuse them.
+func GeneratePac(cfg *PacConfig, split *SplitConfig, conncfg *rules.ConnectConfig, port string, usetls bool) (string, error) {
+	host := cfg.ProxyHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	proxy := "PROXY " + net.JoinHostPort(host, port)
+	if usetls {
+		proxy = "HTTPS " + net.JoinHostPort(host, port)
+	}
+
+	pacrules := []*pacRule{}
+	otherwise := proxy
+	var resolvable *pacRule
+	if split != nil {
+		for i, entry := range split.Rules {
+			action, err := parseSplitAction(entry.Action)
+			if err != nil {
+				return "", fmt.Errorf("split rule %d: %v", i, err)
+			}
+			rule, err := newPacRule(action != SPLITDIRECT, entry.Hosts, entry.Ports, entry.Cidrs)
+			if err != nil {
+				return "", fmt.Errorf("split rule %d: %v", i, err)
+			}
+			rule.Resolve = true
+			pacrules = append(pacrules, rule)
+		}
+		if strings.ToLower(split.Default) == SPLITDIRECT {
+			otherwise = "DIRECT"
+		}
+		if split.Resolve {
+			var err error
+			if resolvable, err = newPacRule(true, split.ResolveHosts, nil, nil); err != nil {
+				return "", fmt.Errorf("split ResolveHosts: %v", err)
+			}
+		}
+	}
+	connect, err := newPacConnect(conncfg)
+	if err != nil {
+		return "", fmt.Errorf("connect-rules: %v", err)
+	}
+	return fmt.Sprintf(pacTemplate, toJson(proxy), toJson(pacrules), toJson(connect), toJson(otherwise), toJson(resolvable)), nil
+}
+
+// / Serve the pac file in the background, generated for each request from the current connect rules
+// / so it follows a config reload
+func ServePac(cfg *PacConfig, split *SplitConfig, conncfg func() *rules.ConnectConfig, port string, usetls bool) {
+	if _, err := GeneratePac(cfg, split, conncfg(), port, usetls); err != nil {
+		log.Println("Unable to generate the pac file, it will be served as an error until fixed", err)
+	}
+	mux := http.NewServeMux()
+	servepac := func(w http.ResponseWriter, req *http.Request) {
+		pac, err := GeneratePac(cfg, split, conncfg(), port, usetls)
+		if err != nil {
+			log.Println("Unable to generate the pac file", err)
+			http.Error(w, "Unable to generate the pac file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		w.Write([]byte(pac))
+	}
+	mux.HandleFunc("/proxy.pac", servepac)
+	mux.HandleFunc("/wpad.dat", servepac)
+	fmt.Println("Serving the pac file at http://" + cfg.Listen + "/proxy.pac")
+	go func() {
+		log.Println("Pac server stopped", http.ListenAndServe(cfg.Listen, mux))
+	}()
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"github.com/299m/util/util"
+	"hdnprxy/proxy"
+	relay2 "hdnprxy/relay"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxPollBody = 1 << 20
+	maxPollHold = 60 * time.Second
+)
+
+// / Open a long polling session - the north is connected as for a net proxy, the south is the poll session
+func (p *Service) HandlePollProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent, params map[string]string) {
+	defer util.OnPanic(w)
+	fmt.Println("Handling poll proxy")
+	if proxycfg.Type != CONNNET && proxycfg.Type != CONNRAWTCP {
+		log.Println("Poll transport not supported for proxy type", proxycfg.Type)
+		http.Error(w, "Server error", 500)
+		return
+	}
+	opts, err := parseTunnelOptions(params, proxycfg)
+	if err != nil {
+		log.Println("Invalid tunnel options ", err)
+		http.Error(w, "Bad request", 400)
+		return
+	}
+
+	north, err := p.connectNorth(proxycfg)
+	if err != nil {
+		log.Println("Unable to connect ", err)
+		http.Error(w, "Server error", 500)
+		return
+	}
+	if p.proxycfg.Lognorth {
+		north.EnableDebugLogs(true, "svc-poll-north")
+	}
+
+	session := relay2.NewPollSession(p.getTimeout(proxycfg), p.removePollSession)
+	p.polllock.Lock()
+	p.pollsessions[session.Id()] = session
+	p.polllock.Unlock()
+	p.DebugLog("Poll session opened", session.Id())
+	south, _ := opts.wrapSouth(session, nil)
+
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(proxycfg.RuleSet))
+	processor.SetClient(maskKey(params[p.proxyparam]), req.RemoteAddr)
+	go processor.ProcessNorthbound()
+	go processor.ProcessSouthbound()
+
+	for name, values := range opts.header() {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(session.Id()))
+}
+
+func (p *Service) removePollSession(id string) {
+	p.polllock.Lock()
+	delete(p.pollsessions, id)
+	p.polllock.Unlock()
+	p.DebugLog("Poll session closed", id)
+}
+
+// / Requests for an existing poll session - POST carries upstream data, GET collects downstream data, DELETE ends it
+func (p *Service) HandlePollSession(w http.ResponseWriter, req *http.Request, sid string) {
+	defer util.OnPanic(w)
+	p.polllock.Lock()
+	session, ok := p.pollsessions[sid]
+	p.polllock.Unlock()
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+
+	query := req.URL.Query()
+	switch req.Method {
+	case http.MethodPost:
+		seq, err := strconv.ParseUint(query.Get(relay2.POLLSEQ), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxPollBody))
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		w.WriteHeader(session.Upload(seq, data))
+	case http.MethodGet:
+		ack, err := strconv.ParseUint(query.Get(relay2.POLLACK), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad request", 400)
+			return
+		}
+		hold := maxPollHold
+		if wait, err := strconv.Atoi(query.Get(relay2.POLLWAIT)); err == nil && time.Duration(wait)*time.Second < hold {
+			hold = time.Duration(wait) * time.Second
+		}
+		data, status := session.Download(ack, hold)
+		if status == http.StatusOK {
+			w.Header().Set(relay2.POLLSEQHEADER, strconv.FormatUint(ack, 10))
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		w.WriteHeader(status)
+		w.Write(data)
+	case http.MethodDelete:
+		session.Close()
+	default:
+		http.Error(w, "Bad request", 400)
+	}
+}
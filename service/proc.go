@@ -16,6 +16,8 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,8 +35,9 @@ var upgrader = websocket.Upgrader{
 }
 
 type Service struct {
+	cfgpath string
 	content *Content
-	proxies *Proxies
+	proxies atomic.Pointer[Proxies] /// swapped on reload - sessions keep whatever they started with
 
 	proxyparam string
 	proxyroute string
@@ -47,7 +50,16 @@ type Service struct {
 
 	downloadsdir string
 
-	rulesproc *rules.Processor
+	rulesets   atomic.Pointer[rules.RuleSets]
+	configpoll time.Duration
+	reloadlock sync.Mutex
+	rulescfg   *rules.ConnectConfig
+	proxykeys  map[string]string /// what each proxy key looked like at the last reload, to log changes
+
+	polllock     sync.Mutex
+	pollsessions map[string]*relay2.PollSession
+
+	remotes atomic.Pointer[RemoteSelector] /// local side only - the remotes we can tunnel to
 }
 
 func NewService(cfgpath string) *Service {
@@ -59,13 +71,13 @@ func NewService(cfgpath string) *Service {
 		"engine":        &proxy.Config{},
 		"connect-rules": &rules.ConnectConfig{},
 	}
-	util.ReadConfig(cfgpath, configs)
+	readConfig(cfgpath, configs)
 	timeout, err := time.ParseDuration(configs["general"].(*General).Timeout)
 	util.CheckError(err)
 
 	svc := &Service{
+		cfgpath:        cfgpath,
 		content:        configs["content"].(*Content),
-		proxies:        configs["proxies"].(*Proxies),
 		proxyparam:     configs["general"].(*General).ProxyParam, // e.g. name
 		proxyroute:     configs["general"].(*General).ProxyRoute, // e.g. /proxy
 		timeout:        timeout,
@@ -74,15 +86,26 @@ func NewService(cfgpath string) *Service {
 		proxycfg:       configs["engine"].(*proxy.Config),
 		debuglogs:      configs["general"].(*General).Debuglogs,
 		downloadsdir:   configs["content"].(*Content).Downloaddir,
-		rulesproc:      rules.NewProcessor(configs["connect-rules"].(*rules.ConnectConfig)),
+		rulescfg:       configs["connect-rules"].(*rules.ConnectConfig),
+		pollsessions:   make(map[string]*relay2.PollSession),
+	}
+	svc.configpoll = 5 * time.Second
+	if configs["general"].(*General).ConfigPoll != "" {
+		svc.configpoll, err = time.ParseDuration(configs["general"].(*General).ConfigPoll)
+		util.CheckError(err)
 	}
+	svc.rulesets.Store(rules.NewRuleSets(svc.rulescfg))
+	util.CheckError(checkRuleSets(configs["proxies"].(*Proxies), svc.rulesets.Load()))
+	svc.proxies.Store(configs["proxies"].(*Proxies))
+	svc.proxykeys = describeProxies(configs["proxies"].(*Proxies))
+	svc.remotes.Store(newRemotes(configs["proxies"].(*Proxies), svc.timeout, svc.allowedcacerts))
 	if !configs["general"].(*General).IsLocal {
 		http.HandleFunc("/", svc.HandleHtml)
 		http.HandleFunc("/home", svc.HandleHome)
 		fmt.Println("Proxy route", svc.proxyroute)
 		http.HandleFunc(svc.proxyroute, svc.HandleProxy)
 	}
-	svc.DebugLog("Proxies ", svc.proxies.Proxies)
+	svc.DebugLog("Proxies ", svc.proxies.Load().Proxies)
 
 	return svc
 }
@@ -98,6 +121,10 @@ func (p *Service) DebugLog(msg ...any) {
 func (p *Service) HandleProxy(res http.ResponseWriter, req *http.Request) {
 	defer util.OnPanic(res)
 	p.DebugLog("Http handle proxy")
+	if sid := req.URL.Query().Get(relay2.POLLSESSION); sid != "" {
+		p.HandlePollSession(res, req, sid)
+		return
+	}
 	///read the proxy param and see if it matches any of the keys
 	dec := json.NewDecoder(req.Body)
 	data := make(map[string]string)
@@ -110,22 +137,27 @@ func (p *Service) HandleProxy(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	proxy, ok := p.proxies.Proxies[proxykey]
+	proxy, ok := p.proxies.Load().Proxies[proxykey]
 	if !ok {
 		log.Println("Proxy not found", proxykey)
 		http.Error(res, "Not found", 404)
 		return
 	}
 
+	if data["transport"] == relay2.POLLTRANSPORT {
+		p.HandlePollProxy(res, req, proxy, data)
+		return
+	}
+
 	switch proxy.Type {
 	case CONNNET, CONNRAWTCP:
-		p.HandleNetProxy(res, req, proxy)
+		p.HandleNetProxy(res, req, proxy, data)
 	case CONNWEBSOCK:
-		p.HandleWsProxy(res, req, proxy)
+		p.HandleWsProxy(res, req, proxy, data)
 	case CONNNETTOWEBSOCK:
-		p.HandleNetWSProxy(res, req, proxy)
+		p.HandleNetWSProxy(res, req, proxy, data)
 	case CONNWEBSOCKNET:
-		p.HandleWSNetProxy(res, req, proxy)
+		p.HandleWSNetProxy(res, req, proxy, data)
 	default:
 		log.Println("Invalid proxy type", proxy.Type)
 		http.Error(res, "Server error", 500)
@@ -193,7 +225,7 @@ func (p *Service) HandleHome(res http.ResponseWriter, req *http.Request) {
 	http.ServeContent(res, req, "home", stats.ModTime(), f)
 }
 
-func (p *Service) HandleLocalTunnel(conn net.Conn, proxycontent *ProxyContent, tunnel *Tunnel) {
+func (p *Service) HandleLocalTunnel(conn net.Conn, tunnel *Tunnel) {
 	defer util.OnPanicFunc()
 	// / Create a new client from the connection
 	fmt.Println("Handling tunnel")
@@ -201,45 +233,136 @@ func (p *Service) HandleLocalTunnel(conn net.Conn, proxycontent *ProxyContent, t
 
 	south := relay2.NewClientFromConn(conn, p.timeout)
 
-	north := relay2.NewTunnelClient(proxycontent.Proxyendpoint, p.timeout, tunnel.Paramname, tunnel.Paramval)
-	north.AllowCert(p.allowedcacerts)
-	err := north.Connect()
-	util.CheckError(err)
-	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesproc)
+	var pending []byte
+	if tunnel.split != nil {
+		req, data, err := readFirstRequest(conn, p.timeout)
+		if err != nil {
+			log.Println("Unable to read the first request", err)
+			conn.Close()
+			return
+		}
+		pending = data
+		if req != nil {
+			action, rule := tunnel.split.Decide(req.Target)
+			fmt.Println("Split tunnel", req.Target, action, "("+rule+")")
+			switch action {
+			case SPLITDIRECT:
+				p.handleDirect(conn, tunnel.split, req, data)
+				return
+			case SPLITREJECT:
+				replySplitReject(conn, req)
+				return
+			}
+		}
+	}
+
+	north, err := p.connectTunnelWithRetry(tunnel)
+	if err != nil {
+		log.Println("Unable to set up tunnel", err)
+		replyTunnelFailure(conn, pending, err)
+		conn.Close()
+		return
+	}
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(""))
+	processor.SetClient("", conn.RemoteAddr().String())
+	processor.SetPending(pending)
 	go processor.ProcessNorthbound()
 	go processor.ProcessSouthbound()
 	fmt.Println("Tunnel setup complete")
 }
 
-func ProxyListenAndServe(servercfg *configs.TlsConfig, svc *Service, tunnel *Tunnel) {
+// / The north side of a local tunnel - a hijacked http stream by default, or long polling if the network won't allow that
+func (p *Service) newTunnelRelay(endpoint string, tunnel *Tunnel) relay2.Relay {
+	if tunnel.Transport == relay2.POLLTRANSPORT {
+		north := relay2.NewHttpPollRelay(endpoint, p.timeout, tunnel.Paramname, tunnel.Paramval)
+		north.AllowCert(p.allowedcacerts)
+		return north
+	}
+	north := relay2.NewTunnelClient(endpoint, p.timeout, tunnel.Paramname, tunnel.Paramval)
+	north.AllowCert(p.allowedcacerts)
+	return north
+}
 
-	/// Start a tls listener
-	/// Load the server certs
-	cer, err := tls.LoadX509KeyPair(servercfg.Cert, servercfg.Key)
-	util.CheckError(err)
-	tlsconfig := &tls.Config{
-		Certificates: []tls.Certificate{cer},
+// / Wrap the north side of a local tunnel in the optional layers from tunnel.json
+func wrapTunnelRelay(north relay2.Relay, tunnel *Tunnel) relay2.Relay {
+	if tunnel.Shaping != nil {
+		north = relay2.NewShapedRelay(north, tunnel.Shaping)
+	}
+	if tunnel.E2e {
+		north = relay2.NewSecureRelay(north, tunnel.E2eSecret)
+	}
+	return north
+}
+
+// / Connect, converting a panic in the relay into an error so we can move on to the next remote
+func tryConnect(north relay2.Relay) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	return north.Connect()
+}
+
+// / Open a tunnel to the best remote, failing over to the others in turn, giving up at deadline
+func (p *Service) connectTunnel(tunnel *Tunnel, deadline time.Time) (relay2.Relay, error) {
+	remotes := p.remotes.Load()
+	if remotes == nil {
+		return nil, fmt.Errorf("no tunnel proxy configured")
+	}
+	var lasterr error
+	for _, endpoint := range remotes.Candidates() {
+		if !time.Now().Before(deadline) {
+			if lasterr == nil {
+				lasterr = fmt.Errorf("tunnel setup: %w", os.ErrDeadlineExceeded)
+			}
+			break
+		}
+		north := wrapTunnelRelay(p.newTunnelRelay(endpoint, tunnel), tunnel)
+		deadliner, _ := north.(relay2.ConnectDeadliner)
+		if deadliner != nil {
+			deadliner.SetConnectDeadline(deadline)
+		}
+		lasterr = tryConnect(north)
+		if lasterr == nil {
+			if deadliner != nil {
+				deadliner.SetConnectDeadline(time.Time{})
+			}
+			remotes.MarkOk(endpoint, 0)
+			return north, nil
+		}
+		log.Println("Unable to tunnel to", endpoint, lasterr)
+		remotes.MarkFailed(endpoint, lasterr)
 	}
+	return nil, lasterr
+}
+
+func ProxyListenAndServe(servercfg *configs.TlsConfig, certs *CertStore, svc *Service, tunnel *Tunnel) {
 
+	/// Start a tls listener
 	fmt.Println("Starting tunnel server on port", servercfg.Port)
-	listener, err := tls.Listen("tcp", ":"+servercfg.Port, tlsconfig)
+	listener, err := tls.Listen("tcp", ":"+servercfg.Port, certs.TlsConfig())
 	util.CheckError(err)
 	for {
 		conn, err := listener.Accept()
 		util.CheckError(err)
-		svc.HandleLocalTunnel(conn, svc.proxies.Proxies["tunnel"], tunnel) /// this should return after setting up the tunnel
+		go svc.HandleLocalTunnel(conn, tunnel)
 	}
 
 }
 
 func sendResponse(conn net.Conn, status string, statuscode int) {
+	sendResponseHeaders(conn, status, statuscode, http.Header{})
+}
+
+func sendResponseHeaders(conn net.Conn, status string, statuscode int, header http.Header) {
 	resp := http.Response{
 		Status:        status,
 		StatusCode:    statuscode,
 		Proto:         "HTTP/1.1",
 		ProtoMajor:    1,
 		ProtoMinor:    1,
-		Header:        http.Header{},
+		Header:        header,
 		ContentLength: 0,
 		Close:         false,
 		Uncompressed:  false,
@@ -277,62 +400,72 @@ func HandleConnect(conn net.Conn) {
 }
 */
 
-func handleIncomingNetConn(conn net.Conn, err error, upgradetotls bool, servercfg *configs.TlsConfig, svc *Service, tunnel *Tunnel) {
+// / certs is nil when the connection stays plain tcp
+func handleIncomingNetConn(conn net.Conn, err error, certs *CertStore, svc *Service, tunnel *Tunnel) {
 	defer util.OnPanicFunc()
 	util.CheckError(err)
 	//HandleConnect(conn)
-	if upgradetotls {
-		/// Start a tls listener
-		/// Load the server certs
-		cer, err := tls.LoadX509KeyPair(servercfg.Cert, servercfg.Key)
-		util.CheckError(err)
-		tlsconfig := &tls.Config{
-			Certificates: []tls.Certificate{cer},
-		}
-		conn = tls.Server(conn, tlsconfig)
+	if certs != nil {
+		conn = tls.Server(conn, certs.TlsConfig())
 	}
-	svc.HandleLocalTunnel(conn, svc.proxies.Proxies["tunnel"], tunnel) /// this should return after setting up the tunnel
+	svc.HandleLocalTunnel(conn, tunnel) /// this should return after setting up the tunnel
 }
 
 // /Run this within your local network - the HTTP Connect is plain text over the network
-func ProxyListenAndServeTcpTls(servercfg *configs.TlsConfig, svc *Service, tunnel *Tunnel, upgradetotls bool) {
+func ProxyListenAndServeTcpTls(servercfg *configs.TlsConfig, certs *CertStore, svc *Service, tunnel *Tunnel) {
 
-	fmt.Println("Starting tunnel server on port", servercfg.Port, "with tls", upgradetotls)
+	fmt.Println("Starting tunnel server on port", servercfg.Port, "with tls", certs != nil)
 	listener, err := net.Listen("tcp", ":"+servercfg.Port)
 	util.CheckError(err)
 	for {
 		conn, err := listener.Accept()
-		go handleIncomingNetConn(conn, err, upgradetotls, servercfg, svc, tunnel)
+		go handleIncomingNetConn(conn, err, certs, svc, tunnel)
 	}
 
 }
 
-func ListenAndServeHttps(servercfg *configs.TlsConfig) {
+func ListenAndServeHttps(servercfg *configs.TlsConfig, certs *CertStore) {
 	// Start the server
 	fmt.Println("Starting server on port", servercfg.Port, "with cert", servercfg.Cert, "and key", servercfg.Key)
-	err := http.ListenAndServeTLS(":"+servercfg.Port, servercfg.Cert, servercfg.Key, nil)
+	server := &http.Server{Addr: ":" + servercfg.Port, TLSConfig: certs.TlsConfig()}
+	err := server.ListenAndServeTLS("", "")
 
 	util.CheckError(err)
 }
 
 func ListenAndServeTls(cfgpath string) {
 	svc := NewService(cfgpath)
+	svc.WatchConfig()
 	servercfg := &configs.TlsConfig{}
 	tunnel := &Tunnel{}
 	tlsconfig := map[string]util.Expandable{
 		"tls":    servercfg,
 		"tunnel": tunnel,
 	}
-	util.ReadConfig(cfgpath, tlsconfig)
+	readConfig(cfgpath, tlsconfig)
+	if tunnel.Pac != nil {
+		ServePac(tunnel.Pac, tunnel.Split, func() *rules.ConnectConfig { return svc.rulesets.Load().Config() }, servercfg.Port, servercfg.IsProxy || servercfg.IsTlsProxy)
+	}
+	var certs *CertStore
+	if !servercfg.IsTcpProxy {
+		certs = NewCertStore(servercfg)
+		certpoll := time.Minute
+		if servercfg.CertPoll != "" {
+			var err error
+			certpoll, err = time.ParseDuration(servercfg.CertPoll)
+			util.CheckError(err)
+		}
+		certs.Watch(certpoll)
+	}
 
 	if tlsconfig["tls"].(*configs.TlsConfig).IsProxy {
-		ProxyListenAndServe(servercfg, svc, tunnel)
+		ProxyListenAndServe(servercfg, certs, svc, tunnel)
 	} else if tlsconfig["tls"].(*configs.TlsConfig).IsHttps {
-		ListenAndServeHttps(servercfg)
+		ListenAndServeHttps(servercfg, certs)
 	} else if tlsconfig["tls"].(*configs.TlsConfig).IsTlsProxy {
-		ProxyListenAndServeTcpTls(servercfg, svc, tunnel, true)
+		ProxyListenAndServeTcpTls(servercfg, certs, svc, tunnel)
 	} else if tlsconfig["tls"].(*configs.TlsConfig).IsTcpProxy {
-		ProxyListenAndServeTcpTls(servercfg, svc, tunnel, false)
+		ProxyListenAndServeTcpTls(servercfg, nil, svc, tunnel)
 	} else {
 		log.Panicln("Invalid tls config, one of IsProxy or IsHttps must be set")
 	}
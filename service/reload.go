@@ -0,0 +1,222 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/299m/util/util"
+	"hdnprxy/rules"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// / The files that can change under a running service - everything else still needs a restart
+var reloadable = []string{"proxies", "connect-rules"}
+
+// / Read the reloadable config files. Anything readConfig or the rule parsing would panic on comes
+// / back as an error instead, so a bad edit leaves the running config alone.
+func readReloadable(cfgpath string) (proxies *Proxies, conncfg *rules.ConnectConfig, sets *rules.RuleSets, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	configs := map[string]util.Expandable{
+		"proxies":       &Proxies{},
+		"connect-rules": &rules.ConnectConfig{},
+	}
+	readConfig(cfgpath, configs)
+	proxies = configs["proxies"].(*Proxies)
+	conncfg = configs["connect-rules"].(*rules.ConnectConfig)
+	sets = rules.NewRuleSets(conncfg)
+	if err := checkRuleSets(proxies, sets); err != nil {
+		sets.Close()
+		return nil, nil, nil, err
+	}
+	return proxies, conncfg, sets, nil
+}
+
+// / Every rule set a proxy key names has to exist
+func checkRuleSets(proxies *Proxies, sets *rules.RuleSets) error {
+	for key, proxy := range proxies.Proxies {
+		if !sets.Has(proxy.RuleSet) {
+			return fmt.Errorf("proxy %s uses rule set %s which isn't in connect-rules.json", maskKey(key), proxy.RuleSet)
+		}
+	}
+	return nil
+}
+
+// / A printable summary of each proxy key, keys are masked as they're effectively passwords
+func describeProxies(proxies *Proxies) map[string]string {
+	described := make(map[string]string, len(proxies.Proxies))
+	for key, proxy := range proxies.Proxies {
+		desc := fmt.Sprint(proxy.Type, " ", proxy.Endpoints())
+		if proxy.E2eSecret != "" {
+			desc += " e2e"
+		}
+		if proxy.RuleSet != "" {
+			desc += " rule set " + proxy.RuleSet
+		}
+		if len(proxy.Routes) > 0 {
+			desc += fmt.Sprint(" ", len(proxy.Routes), " routes ", toJson(proxy.Routes))
+		}
+		described[maskKey(key)] = desc
+	}
+	return described
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return key[:2] + "****" + key[len(key)-2:]
+}
+
+// / Re-read proxies.json and connect-rules.json and swap them in. Tunnels already running keep the
+// / config they started with, new ones get the new config. If anything is invalid nothing changes.
+func (p *Service) Reload() error {
+	p.reloadlock.Lock()
+	defer p.reloadlock.Unlock()
+
+	proxies, conncfg, sets, err := readReloadable(p.cfgpath)
+	if err != nil {
+		log.Println("Config reload failed, keeping the current config:", err)
+		return err
+	}
+
+	changed := false
+	proxykeys := describeProxies(proxies)
+	for key, desc := range proxykeys {
+		if old, ok := p.proxykeys[key]; !ok {
+			log.Println("Config reload: proxy", key, "added", desc)
+			changed = true
+		} else if old != desc {
+			log.Println("Config reload: proxy", key, "changed from", old, "to", desc)
+			changed = true
+		}
+	}
+	for key := range p.proxykeys {
+		if _, ok := proxykeys[key]; !ok {
+			log.Println("Config reload: proxy", key, "removed")
+			changed = true
+		}
+	}
+	for _, change := range diffRules(p.rulescfg, conncfg) {
+		log.Println("Config reload:", change)
+		changed = true
+	}
+	if !changed {
+		log.Println("Config reload: no changes")
+		sets.Close()
+		return nil
+	}
+
+	p.rulesets.Swap(sets).Close()
+	p.rulescfg = conncfg
+	p.proxykeys = proxykeys
+	oldtunnel, hadtunnel := p.proxies.Load().Proxies["tunnel"]
+	newtunnel, hastunnel := proxies.Proxies["tunnel"]
+	p.proxies.Store(proxies)
+	if hadtunnel != hastunnel || (hastunnel && !reflect.DeepEqual(oldtunnel, newtunnel)) {
+		old := p.remotes.Swap(newRemotes(proxies, p.timeout, p.allowedcacerts))
+		if old != nil {
+			old.Stop()
+		}
+	}
+	return nil
+}
+
+// / What changed between two rule sets, in words
+func diffRules(old *rules.ConnectConfig, updated *rules.ConnectConfig) []string {
+	var changes []string
+	oldrules := make(map[string]string)
+	for i, entry := range old.Rules {
+		oldrules[ruleName(i, entry)] = toJson(entry)
+	}
+	newrules := make(map[string]string)
+	for i, entry := range updated.Rules {
+		name := ruleName(i, entry)
+		newrules[name] = toJson(entry)
+		if prev, ok := oldrules[name]; !ok {
+			changes = append(changes, "rule "+name+" added")
+		} else if prev != newrules[name] {
+			changes = append(changes, "rule "+name+" changed")
+		}
+	}
+	for name := range oldrules {
+		if _, ok := newrules[name]; !ok {
+			changes = append(changes, "rule "+name+" removed")
+		}
+	}
+	sort.Strings(changes)
+	if len(changes) == 0 && toJson(old.Rules) != toJson(updated.Rules) {
+		changes = append(changes, "rules reordered")
+	}
+
+	oldrest, newrest := *old, *updated
+	oldrest.Rules, newrest.Rules = nil, nil
+	if toJson(oldrest) != toJson(newrest) {
+		changes = append(changes, fmt.Sprint("connect rules changed, now ", len(updated.Rules), " rules, ",
+			len(updated.Whitelist), " whitelist and ", len(updated.Blacklist), " blacklist entries"))
+	}
+	return changes
+}
+
+func ruleName(i int, entry rules.RuleEntry) string {
+	if entry.Name != "" {
+		return entry.Name
+	}
+	return fmt.Sprint("rule-", i)
+}
+
+func toJson(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// / Reload whenever a reloadable file changes, checked every configpoll, or on SIGHUP
+func (p *Service) WatchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP, reloading config")
+			p.Reload()
+		}
+	}()
+	if p.configpoll <= 0 {
+		return
+	}
+	go func() {
+		last := p.configModTimes()
+		for {
+			time.Sleep(p.configpoll)
+			current := p.configModTimes()
+			if !reflect.DeepEqual(last, current) {
+				last = current
+				p.Reload()
+			}
+		}
+	}()
+}
+
+func (p *Service) configModTimes() map[string]time.Time {
+	modtimes := make(map[string]time.Time)
+	if isConfigFile(p.cfgpath) {
+		if info, err := os.Stat(p.cfgpath); err == nil {
+			modtimes[p.cfgpath] = info.ModTime()
+		}
+		return modtimes
+	}
+	for _, file := range reloadable {
+		if info, err := os.Stat(filepath.Join(p.cfgpath, file+".json")); err == nil {
+			modtimes[file] = info.ModTime()
+		}
+	}
+	return modtimes
+}
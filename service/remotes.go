@@ -0,0 +1,181 @@
+package service
+
+import (
+	"fmt"
+	relay2 "hdnprxy/relay"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type remoteState struct {
+	endpoint string
+	order    int
+	healthy  bool
+	latency  time.Duration /// 0 until we've measured it
+}
+
+// / Keeps track of the remotes a local side can tunnel to. They're health checked in the background, new
+// / tunnels try the fastest healthy one first and fall back through the rest in order.
+type RemoteSelector struct {
+	done    chan struct{}
+	lock    sync.Mutex
+	remotes []*remoteState
+	current string
+
+	timeout        time.Duration
+	allowedcacerts []string
+}
+
+func NewRemoteSelector(endpoints []string, timeout time.Duration, allowedcacerts []string) *RemoteSelector {
+	r := &RemoteSelector{
+		done:           make(chan struct{}),
+		timeout:        timeout,
+		allowedcacerts: allowedcacerts,
+	}
+	for i, endpoint := range endpoints {
+		r.remotes = append(r.remotes, &remoteState{endpoint: endpoint, order: i, healthy: true})
+	}
+	return r
+}
+
+// / The selector for the "tunnel" proxy, if there is one, with health checks running if there's a choice
+func newRemotes(proxies *Proxies, timeout time.Duration, allowedcacerts []string) *RemoteSelector {
+	tunnel, ok := proxies.Proxies["tunnel"]
+	if !ok {
+		return nil
+	}
+	remotes := NewRemoteSelector(tunnel.Endpoints(), timeout, allowedcacerts)
+	if len(tunnel.Endpoints()) > 1 {
+		remotes.Start(tunnel.healthcheck)
+	}
+	return remotes
+}
+
+// / Health check every remote now and then every interval after that, until Stop
+func (r *RemoteSelector) Start(interval time.Duration) {
+	go func() {
+		for {
+			r.checkAll()
+			select {
+			case <-r.done:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+func (r *RemoteSelector) Stop() {
+	close(r.done)
+}
+
+func (r *RemoteSelector) checkAll() {
+	var wait sync.WaitGroup
+	for _, remote := range r.remotes {
+		wait.Add(1)
+		go func(endpoint string) {
+			defer wait.Done()
+			latency, err := r.probe(endpoint)
+			if err != nil {
+				r.MarkFailed(endpoint, err)
+			} else {
+				r.MarkOk(endpoint, latency)
+			}
+		}(remote.endpoint)
+	}
+	wait.Wait()
+}
+
+// / Time how long it takes to reach the remote - a plain tls connection, no tunnel request
+func (r *RemoteSelector) probe(endpoint string) (latency time.Duration, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("%v", rec)
+		}
+	}()
+	client := relay2.NewClientv2(endpoint, r.timeout, true)
+	client.AllowCert(r.allowedcacerts)
+	start := time.Now()
+	err = client.Connect()
+	if err != nil {
+		return 0, err
+	}
+	latency = time.Since(start)
+	client.Close()
+	return latency, nil
+}
+
+func (r *RemoteSelector) find(endpoint string) *remoteState {
+	for _, remote := range r.remotes {
+		if remote.endpoint == endpoint {
+			return remote
+		}
+	}
+	return nil
+}
+
+// / A latency of 0 marks the remote healthy but keeps the last measurement
+func (r *RemoteSelector) MarkOk(endpoint string, latency time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if remote := r.find(endpoint); remote != nil {
+		remote.healthy = true
+		if latency > 0 {
+			remote.latency = latency
+		}
+	}
+	r.updateCurrent()
+}
+
+func (r *RemoteSelector) MarkFailed(endpoint string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if remote := r.find(endpoint); remote != nil {
+		if remote.healthy {
+			log.Println("Remote", endpoint, "is down:", err)
+		}
+		remote.healthy = false
+	}
+	r.updateCurrent()
+}
+
+// / Healthy before unhealthy, then measured before not yet measured, then lowest latency, then config order.
+// / Unhealthy remotes stay on the end of the list as a last resort - they may have come back since the last check.
+func (r *RemoteSelector) ranked() []*remoteState {
+	ranked := append([]*remoteState{}, r.remotes...)
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if measured := a.latency > 0; measured != (b.latency > 0) {
+			return measured
+		}
+		if a.latency != b.latency {
+			return a.latency < b.latency
+		}
+		return a.order < b.order
+	})
+	return ranked
+}
+
+func (r *RemoteSelector) updateCurrent() {
+	best := r.ranked()[0]
+	if best.endpoint != r.current {
+		r.current = best.endpoint
+		log.Println("Using remote", best.endpoint, "healthy", best.healthy, "latency", best.latency)
+	}
+}
+
+// / Endpoints to try for a new tunnel, best first
+func (r *RemoteSelector) Candidates() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	candidates := make([]string, 0, len(r.remotes))
+	for _, remote := range r.ranked() {
+		candidates = append(candidates, remote.endpoint)
+	}
+	return candidates
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/299m/util/util"
+	"hdnprxy/rules"
+	"io"
+	"strings"
+	"time"
+)
+
+// / One destination to check, and optionally what the rules are expected to do with it
+type ruleCase struct {
+	expect string /// "allow", "deny", "drop", "block" (deny or drop) or "" to just print the decision
+	target string
+}
+
+func parseRuleCase(line string) (*ruleCase, error) {
+	if expect, target, ok := strings.Cut(line, "="); ok {
+		line = expect + " " + target /// "allow=example.com:443" on the command line
+	}
+	fields := strings.Fields(line)
+	switch len(fields) {
+	case 1:
+		return &ruleCase{target: fields[0]}, nil
+	case 2:
+		expect := strings.ToLower(fields[0])
+		switch expect {
+		case "allow", "deny", "drop", "block":
+			return &ruleCase{expect: expect, target: fields[1]}, nil
+		}
+		return nil, fmt.Errorf("unknown expectation %s, use allow, deny, drop or block", fields[0])
+	}
+	return nil, fmt.Errorf("expected \"[allow|deny|drop|block] host:port\" or \"allow=host:port\", got %q", line)
+}
+
+func (c *ruleCase) check(verdict rules.Verdict) bool {
+	switch c.expect {
+	case "allow":
+		return verdict.Response == rules.ALLOW
+	case "deny":
+		return verdict.Response == rules.REPSONDFAIL
+	case "drop":
+		return verdict.Response == rules.DROPFLAT
+	case "block":
+		return verdict.Response != rules.ALLOW
+	}
+	return true
+}
+
+// / Evaluate one destination the way a CONNECT to it would be
+func evaluateRuleCase(proc *rules.Processor, target string) rules.Verdict {
+	var decided rules.Verdict
+	session := proc.NewSession()
+	session.OnDecision = func(req *rules.Request, verdict rules.Verdict) {
+		decided = verdict
+	}
+	_, verdict := session.Process([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"))
+	if verdict.Response == decided.Response {
+		return decided /// the same decision, along with the rule that made it
+	}
+	return verdict
+}
+
+// / Find the rule set a proxy key uses
+func ruleSetForKey(cfgpath string, key string) (string, error) {
+	proxies := &Proxies{}
+	readConfig(cfgpath, map[string]util.Expandable{"proxies": proxies})
+	proxy, ok := proxies.Proxies[key]
+	if !ok {
+		return "", fmt.Errorf("no proxy key %s in proxies.json", maskKey(key))
+	}
+	return proxy.RuleSet, nil
+}
+
+// / hdnprxy rules test --config <dir> [allow=]host:port ...
+// / Destinations come from the arguments, or one per line on stdin as "[allow|deny|drop|block] host:port".
+// / Returns the exit code - 1 if any expectation wasn't met, 2 for a bad config or arguments.
+func RunRulesTest(args []string, stdin io.Reader, stdout io.Writer) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintln(stdout, "Unable to load the rules:", r)
+			code = 2
+		}
+	}()
+	flags := flag.NewFlagSet("rules test", flag.ContinueOnError)
+	cfgpath := flags.String("config", "", "Path to the configuration file(s)")
+	ruleset := flags.String("ruleset", "", "Named rule set to test, the global rules by default")
+	key := flags.String("key", "", "Test the rule set this proxy key uses")
+	at := flags.String("at", "", "Evaluate schedules as if it were this time, RFC 3339 e.g. 2026-01-05T10:00:00Z")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var cases []*ruleCase
+	lines := flags.Args()
+	if len(lines) == 0 {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	}
+	for _, line := range lines {
+		c, err := parseRuleCase(line)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			return 2
+		}
+		cases = append(cases, c)
+	}
+
+	if *key != "" {
+		var err error
+		if *ruleset, err = ruleSetForKey(*cfgpath, *key); err != nil {
+			fmt.Fprintln(stdout, err)
+			return 2
+		}
+	}
+	conncfg := &rules.ConnectConfig{}
+	readConfig(*cfgpath, map[string]util.Expandable{"connect-rules": conncfg})
+	/// test what the rules would do - without writing to the real audit log, and as if they were enforced.
+	/// Ssrf is left out, it depends on what names resolve to at the time rather than on the rules.
+	ssrf := conncfg.Ssrf != nil && conncfg.Ssrf.Enabled
+	conncfg.Audit, conncfg.Mode, conncfg.Ssrf = nil, "", nil
+	for _, setcfg := range conncfg.RuleSets {
+		ssrf = ssrf || (setcfg.Ssrf != nil && setcfg.Ssrf.Enabled)
+		setcfg.Audit, setcfg.Mode, setcfg.Ssrf = nil, "", nil
+	}
+	if ssrf {
+		fmt.Fprintln(stdout, "Ssrf isn't tested - allowed destinations may still be refused by the address they resolve to")
+	}
+	sets := rules.NewRuleSets(conncfg)
+	defer sets.Close()
+	if !sets.Has(*ruleset) {
+		fmt.Fprintln(stdout, "No rule set", *ruleset, "in connect-rules.json")
+		return 2
+	}
+	proc := sets.Get(*ruleset)
+	if *at != "" {
+		when, err := time.Parse(time.RFC3339, *at)
+		if err != nil {
+			fmt.Fprintln(stdout, "Invalid --at time", err)
+			return 2
+		}
+		proc.Clock = func() time.Time { return when }
+	}
+
+	failed := 0
+	for _, c := range cases {
+		verdict := evaluateRuleCase(proc, c.target)
+		status := "    "
+		if c.expect != "" {
+			status = "ok  "
+			if !c.check(verdict) {
+				status = "FAIL"
+				failed++
+			}
+		}
+		fmt.Fprintf(stdout, "%s %-40s %s\n", status, c.target, verdict)
+	}
+	if failed > 0 {
+		fmt.Fprintln(stdout, failed, "of", len(cases), "expectations failed")
+		return 1
+	}
+	return 0
+}
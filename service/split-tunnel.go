@@ -0,0 +1,269 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"hdnprxy/rules"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SPLITTUNNEL = "tunnel"
+	SPLITDIRECT = "direct"
+	SPLITREJECT = "reject"
+)
+
+// / Decide per connection whether to go through the remote, straight to the destination, or nowhere
+type SplitConfig struct {
+	Rules   []SplitRule /// the first rule to match the first request's destination decides
+	Default string      /// "tunnel" (the default), "direct" or "reject"
+	Resolve bool        /// look names up locally so Cidrs can match them - only those matching ResolveHosts
+	/// The names that may be looked up locally, e.g. "*.corp.example" - the lookup happens outside the
+	/// tunnel, so anything else is never resolved here and its name doesn't leak to the local dns
+	ResolveHosts []string
+}
+
+type SplitRule struct {
+	Name   string
+	Action string   /// "tunnel", "direct" or "reject"
+	Hosts  []string /// same patterns as connect-rules.json - "*.intranet.example", "re:<regex>" ...
+	Ports  []string
+	Cidrs  []string
+}
+
+type splitEntry struct {
+	name    string
+	action  string
+	matcher *rules.DestinationMatcher
+}
+
+type SplitRouter struct {
+	entries       []*splitEntry
+	defaultaction string
+	resolve       *rules.HostMatcher /// nil unless Resolve
+	direct        *http.Transport    /// for plain http requests that go direct
+}
+
+func parseSplitAction(action string) (string, error) {
+	switch strings.ToLower(action) {
+	case SPLITTUNNEL, SPLITDIRECT, SPLITREJECT:
+		return strings.ToLower(action), nil
+	}
+	return "", fmt.Errorf("unknown split tunnel action %s", action)
+}
+
+func NewSplitRouter(cfg *SplitConfig) (*SplitRouter, error) {
+	s := &SplitRouter{
+		defaultaction: SPLITTUNNEL,
+		direct:        &http.Transport{Proxy: nil, DisableCompression: true, IdleConnTimeout: 90 * time.Second},
+	}
+	if cfg.Resolve {
+		if len(cfg.ResolveHosts) == 0 {
+			return nil, fmt.Errorf("Resolve looks names up outside the tunnel - set ResolveHosts to the names that may be, e.g. \"*.corp.example\"")
+		}
+		resolve, err := rules.NewHostMatcher(cfg.ResolveHosts)
+		if err != nil {
+			return nil, fmt.Errorf("ResolveHosts: %v", err)
+		}
+		s.resolve = resolve
+	}
+	if cfg.Default != "" {
+		action, err := parseSplitAction(cfg.Default)
+		if err != nil {
+			return nil, err
+		}
+		s.defaultaction = action
+	}
+	for i, rule := range cfg.Rules {
+		action, err := parseSplitAction(rule.Action)
+		if err != nil {
+			return nil, fmt.Errorf("split rule %d: %v", i, err)
+		}
+		matcher, err := rules.NewDestinationMatcher(rule.Hosts, rule.Ports, rule.Cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("split rule %d: %v", i, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprint("split-", i)
+		}
+		s.entries = append(s.entries, &splitEntry{name: name, action: action, matcher: matcher})
+	}
+	return s, nil
+}
+
+// / What to do with a connection to target, and the rule that decided it
+func (s *SplitRouter) Decide(target string) (action string, rule string) {
+	dest, err := rules.ParseDestination(target)
+	if err != nil {
+		return s.defaultaction, "default"
+	}
+	candidates := []*rules.Destination{dest}
+	if s.resolve != nil && dest.IP == nil && s.resolve.Match(dest.Host) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := net.DefaultResolver.LookupIP(ctx, "ip", dest.Host)
+		cancel()
+		if err == nil {
+			for _, addr := range addrs {
+				candidates = append(candidates, &rules.Destination{Host: addr.String(), Port: dest.Port, IP: addr})
+			}
+		}
+	}
+	for _, entry := range s.entries {
+		for _, candidate := range candidates {
+			if entry.matcher.Match(candidate) {
+				return entry.action, entry.name
+			}
+		}
+	}
+	return s.defaultaction, "default"
+}
+
+const maxRequestHead = 64 * 1024
+
+// / Read the first request head from a local client. Anything that isn't http (e.g. socks) comes back
+// / with a nil request, along with whatever was read so it can still be tunneled.
+func readFirstRequest(conn net.Conn, timeout time.Duration) (*rules.Request, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if first[0] < 'A' || first[0] > 'Z' {
+		data := make([]byte, reader.Buffered())
+		reader.Read(data)
+		return nil, data, nil
+	}
+	var head []byte
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		line, err := reader.ReadSlice('\n')
+		head = append(head, line...)
+		if len(head) > maxRequestHead {
+			return nil, head, fmt.Errorf("request head too large")
+		}
+		if err == bufio.ErrBufferFull {
+			continue /// a line longer than the buffer, keep reading the rest of it
+		}
+		if err != nil {
+			return nil, head, err
+		}
+	}
+	rest := make([]byte, reader.Buffered())
+	reader.Read(rest)
+	req, err := rules.ParseRequest(head)
+	if err != nil {
+		return nil, append(head, rest...), err
+	}
+	return req, append(head, rest...), nil
+}
+
+// / Connect straight to the destination from here, bypassing the remote
+func (p *Service) handleDirect(conn net.Conn, split *SplitRouter, req *rules.Request, data []byte) {
+	if req.Method != "CONNECT" {
+		p.serveDirectHttp(conn, split, data)
+		return
+	}
+	dest, err := net.DialTimeout("tcp", req.Target, p.timeout)
+	if err != nil {
+		log.Println("Unable to connect directly to", req.Target, err)
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+		conn.Close()
+		return
+	}
+	data = data[len(req.Head):]
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if len(data) > 0 {
+		if _, err := dest.Write(data); err != nil {
+			conn.Close()
+			dest.Close()
+			return
+		}
+	}
+	go pipe(dest, conn)
+	go pipe(conn, dest)
+}
+
+// / Caps how much a request head can read from the client - lifted while its body is read
+type headLimit struct {
+	from      io.Reader
+	remaining int64
+}
+
+func (h *headLimit) Read(data []byte) (int, error) {
+	if h.remaining <= 0 {
+		return 0, fmt.Errorf("request head too large")
+	}
+	if int64(len(data)) > h.remaining {
+		data = data[:h.remaining]
+	}
+	n, err := h.from.Read(data)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+// / Plain http requests that go direct are made from here one at a time, each routed again - a keep-alive
+// / connection can ask for somewhere else next. One that isn't direct closes the connection, and the
+// / client reconnects for it so it's routed from the start.
+func (p *Service) serveDirectHttp(conn net.Conn, split *SplitRouter, data []byte) {
+	defer conn.Close()
+	limit := &headLimit{from: io.MultiReader(bytes.NewReader(data), conn)}
+	reader := bufio.NewReader(limit)
+	for {
+		limit.remaining = maxRequestHead
+		conn.SetReadDeadline(time.Now().Add(p.timeout))
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		limit.remaining = math.MaxInt64
+
+		target := req.Host
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(strings.Trim(target, "[]"), "80")
+		}
+		if action, rule := split.Decide(target); action != SPLITDIRECT {
+			fmt.Println("Split tunnel", target, action, "("+rule+") - closing the direct connection")
+			return
+		}
+		req.RequestURI = ""
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		resp, err := split.direct.RoundTrip(req)
+		if err != nil {
+			log.Println("Unable to connect directly to", target, err)
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			return
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+func pipe(to net.Conn, from net.Conn) {
+	io.Copy(to, from)
+	to.Close()
+	from.Close()
+}
+
+func replySplitReject(conn net.Conn, req *rules.Request) {
+	if req != nil {
+		conn.Write([]byte("HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	}
+	conn.Close()
+}
@@ -45,19 +45,31 @@ func (p *Service) getTimeout(proxycfg *ProxyContent) time.Duration {
 	return timeout
 }
 
+// / The north side of a net/raw proxy - connected now, or once the destination is known if the proxy has Routes
+func (p *Service) connectNorth(proxycfg *ProxyContent) (relay2.Relay, error) {
+	dial := func(endpoint string) (relay2.Relay, error) {
+		north := relay2.NewClientv2(endpoint, p.getTimeout(proxycfg), proxycfg.Type == CONNNET)
+		north.AllowCert(p.allowedcacerts)
+		return north, north.Connect()
+	}
+	if proxycfg.router != nil {
+		return newRoutedNorth(proxycfg.router, dial), nil
+	}
+	return dial(proxycfg.Proxyendpoint)
+}
+
 // / Raw tcp proxy - north and south
-func (p *Service) HandleNetProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent) {
+func (p *Service) HandleNetProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent, params map[string]string) {
 	defer util.OnPanic(w)
 	fmt.Println("Handling net proxy")
-
-	usetls := false
-	if proxycfg.Type == CONNNET {
-		usetls = true
+	opts, err := parseTunnelOptions(params, proxycfg)
+	if err != nil {
+		log.Println("Invalid tunnel options ", err)
+		http.Error(w, "Bad request", 400)
+		return
 	}
 
-	north := relay2.NewClientv2(proxycfg.Proxyendpoint, p.getTimeout(proxycfg), usetls)
-	north.AllowCert(p.allowedcacerts)
-	err := north.Connect()
+	north, err := p.connectNorth(proxycfg)
 	if err != nil {
 		log.Println("Unable to connect ", err)
 		http.Error(w, "Server error", 500)
@@ -67,17 +79,17 @@ func (p *Service) HandleNetProxy(w http.ResponseWriter, req *http.Request, proxy
 	conn, pendingdata, err := p.hijack(w)
 	util.CheckError(err)
 
-	sendResponse(conn, "", 200) /// after this, go to raw tcp/tls
+	sendResponseHeaders(conn, "", 200, opts.header()) /// after this, go to raw tcp/tls
 
 	//// Only accept secure connections - make sure this is a tls connection
-	south := relay2.NewClientFromConn(conn.(*tls.Conn), p.getTimeout(proxycfg))
+	var south relay2.Relay = relay2.NewClientFromConn(conn.(*tls.Conn), p.getTimeout(proxycfg))
+	south, pendingdata = opts.wrapSouth(south, pendingdata)
 	if p.proxycfg.Lognorth { /// slightly messy - but lets see whats beign sent
 		north.EnableDebugLogs(true, "svc-net-north")
 	}
-	p.DebugLog("Sending pending data to north", string(pendingdata))
-	north.SendMsg(pendingdata)
-
-	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesproc)
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(proxycfg.RuleSet))
+	processor.SetClient(maskKey(params[p.proxyparam]), req.RemoteAddr)
+	processor.SetPending(pendingdata)
 	go processor.ProcessNorthbound()
 	go processor.ProcessSouthbound()
 }
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	relay2 "hdnprxy/relay"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	TUNNELFAILDNS  = "dns"
+	TUNNELFAILTCP  = "tcp"
+	TUNNELFAILTLS  = "tls"
+	TUNNELFAILAUTH = "auth"
+	TUNNELFAIL     = "unknown"
+)
+
+// / Work out which stage of tunnel setup failed, and how to explain it to the user
+func classifyTunnelError(err error) (kind string, reason string) {
+	var dnserr *net.DNSError
+	var certerr *tls.CertificateVerificationError
+	var authorityerr x509.UnknownAuthorityError
+	var hosterr x509.HostnameError
+	var recorderr tls.RecordHeaderError
+	var alerterr tls.AlertError
+	var operr *net.OpError
+	switch {
+	case errors.Is(err, relay2.ErrTunnelRejected):
+		return TUNNELFAILAUTH, "the remote hdnprxy rejected the tunnel"
+	case errors.As(err, &dnserr):
+		return TUNNELFAILDNS, "could not resolve the remote hdnprxy"
+	case errors.As(err, &certerr), errors.As(err, &authorityerr), errors.As(err, &hosterr),
+		errors.As(err, &recorderr), errors.As(err, &alerterr):
+		return TUNNELFAILTLS, "tls handshake with the remote hdnprxy failed"
+	case errors.As(err, &operr):
+		return TUNNELFAILTCP, "could not connect to the remote hdnprxy"
+	}
+	return TUNNELFAIL, "tunnel setup failed"
+}
+
+// / Keep trying to open the tunnel, backing off with jitter, until it works or the budget runs out.
+// / There's no point retrying when the remote has explicitly said no.
+func (p *Service) connectTunnelWithRetry(tunnel *Tunnel) (relay2.Relay, error) {
+	deadline := time.Now().Add(tunnel.retrybudget)
+	backoff := tunnel.retrybackoff
+	for {
+		north, err := p.connectTunnel(tunnel, deadline)
+		if err == nil || errors.Is(err, relay2.ErrTunnelRejected) {
+			return north, err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if time.Now().Add(wait).After(deadline) {
+			return nil, err
+		}
+		log.Println("Retrying tunnel in", wait, err)
+		time.Sleep(wait)
+		if backoff < 5*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// / Tell the client why it isn't getting a tunnel - a 502 for http proxy clients, the matching reply code
+// / for socks clients - rather than just dropping the connection. pending is anything already read from the client.
+func replyTunnelFailure(conn net.Conn, pending []byte, err error) {
+	kind, reason := classifyTunnelError(err)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(pending), conn))
+	first, peekerr := reader.Peek(1)
+	if peekerr != nil {
+		return
+	}
+	switch first[0] {
+	case 5:
+		replySocks5Failure(reader, conn, kind)
+	case 4:
+		replySocks4Failure(conn)
+	default:
+		http.ReadRequest(reader) /// read the request so the client doesn't see a reset before our reply
+		body := fmt.Sprintln("hdnprxy:", reason+":", err)
+		resp := fmt.Sprint("HTTP/1.1 502 Bad Gateway\r\n",
+			"Content-Type: text/plain\r\n",
+			"X-Hdnprxy-Error: ", kind, "\r\n",
+			"Content-Length: ", len(body), "\r\n",
+			"Connection: close\r\n\r\n", body)
+		conn.Write([]byte(resp))
+	}
+}
+
+func replySocks5Failure(reader *bufio.Reader, conn net.Conn, kind string) {
+	/// greeting - version, number of methods, methods. Accept without auth so we can send the real reason
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if _, err := reader.Discard(int(header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	reader.Peek(4)  /// the connect request - we only need it to have arrived
+	code := byte(1) /// general failure
+	switch kind {
+	case TUNNELFAILDNS, TUNNELFAILTCP:
+		code = 4 /// host unreachable
+	case TUNNELFAILAUTH:
+		code = 2 /// not allowed by ruleset
+	}
+	conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+}
+
+func replySocks4Failure(conn net.Conn) {
+	conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0}) /// request rejected or failed
+}
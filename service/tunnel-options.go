@@ -0,0 +1,63 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	relay2 "hdnprxy/relay"
+	"net/http"
+)
+
+// / Optional layers the local side asked for in its tunnel request
+type tunnelOptions struct {
+	shaping *relay2.ShapingConfig
+	e2e     bool
+	secret  string /// the proxy key's E2eSecret, which is never sent - the proxy key itself goes through the front in the clear
+}
+
+func parseTunnelOptions(params map[string]string, proxycfg *ProxyContent) (*tunnelOptions, error) {
+	opts := &tunnelOptions{
+		e2e:    params[relay2.E2EPARAM] != "",
+		secret: proxycfg.E2eSecret,
+	}
+	if opts.e2e && opts.secret == "" {
+		return nil, errors.New("e2e asked for, but the proxy key has no E2eSecret")
+	}
+	if shape := params[relay2.SHAPEPARAM]; shape != "" {
+		opts.shaping = &relay2.ShapingConfig{}
+		err := json.Unmarshal([]byte(shape), opts.shaping)
+		if err != nil {
+			return nil, err
+		}
+		err = opts.shaping.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+// / Headers for the tunnel reply, telling the local side which layers we agreed to
+func (t *tunnelOptions) header() http.Header {
+	header := http.Header{}
+	if t.shaping != nil {
+		header.Set(relay2.SHAPEHEADER, "1")
+	}
+	if t.e2e {
+		header.Set(relay2.E2EHEADER, "1")
+	}
+	return header
+}
+
+// / Wrap the south side of the tunnel in the agreed layers. Anything read past the handshake belongs
+// / to the wrapped stream, so it is handed over and nil is returned in its place.
+func (t *tunnelOptions) wrapSouth(south relay2.Relay, pending []byte) (relay2.Relay, []byte) {
+	if t.shaping != nil {
+		south = relay2.NewShapedRelayFromConn(south, t.shaping, pending)
+		pending = nil
+	}
+	if t.e2e {
+		south = relay2.NewSecureRelayFromConn(south, t.secret, pending)
+		pending = nil
+	}
+	return south, pending
+}
@@ -0,0 +1,188 @@
+package service
+
+import (
+	"fmt"
+	relay2 "hdnprxy/relay"
+	"hdnprxy/rules"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// / How long an upstream that failed to connect goes to the back of the queue
+const upstreamDownFor = 30 * time.Second
+
+// / Send destinations matching Hosts/Ports/Cidrs to Upstreams, tried in order
+type RouteEntry struct {
+	Name      string
+	Hosts     []string /// same patterns as connect-rules.json - "*.corp.example", "re:<regex>" ...
+	Ports     []string
+	Cidrs     []string
+	Upstreams []string
+}
+
+type upstreamRoute struct {
+	name      string
+	matcher   *rules.DestinationMatcher
+	upstreams []string
+}
+
+// / Picks the upstreams for a session from its first request's destination. Upstreams that failed
+// / recently are still tried, but only after the rest.
+type UpstreamRouter struct {
+	routes   []*upstreamRoute
+	fallback []string
+
+	lock sync.Mutex
+	down map[string]time.Time
+}
+
+func NewUpstreamRouter(entries []RouteEntry, fallback []string) (*UpstreamRouter, error) {
+	r := &UpstreamRouter{fallback: fallback, down: make(map[string]time.Time)}
+	for i, entry := range entries {
+		matcher, err := rules.NewDestinationMatcher(entry.Hosts, entry.Ports, entry.Cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		if len(entry.Upstreams) == 0 {
+			return nil, fmt.Errorf("route %d has no upstreams", i)
+		}
+		name := entry.Name
+		if name == "" {
+			name = fmt.Sprint("route-", i)
+		}
+		r.routes = append(r.routes, &upstreamRoute{name: name, matcher: matcher, upstreams: entry.Upstreams})
+	}
+	return r, nil
+}
+
+// / The route a destination takes and its upstreams, in the order to try them
+func (r *UpstreamRouter) Candidates(target string) (string, []string) {
+	route, upstreams := "default", r.fallback
+	if dest, err := rules.ParseDestination(target); err == nil {
+		for _, entry := range r.routes {
+			if entry.matcher.Match(dest) {
+				route, upstreams = entry.name, entry.upstreams
+				break
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ordered := make([]string, 0, len(upstreams))
+	var down []string
+	for _, upstream := range upstreams {
+		if since, ok := r.down[upstream]; ok && time.Since(since) < upstreamDownFor {
+			down = append(down, upstream)
+		} else {
+			ordered = append(ordered, upstream)
+		}
+	}
+	return route, append(ordered, down...)
+}
+
+func (r *UpstreamRouter) MarkDown(upstream string, err error) {
+	log.Println("Upstream", upstream, "is down", err)
+	r.lock.Lock()
+	r.down[upstream] = time.Now()
+	r.lock.Unlock()
+}
+
+func (r *UpstreamRouter) MarkUp(upstream string) {
+	r.lock.Lock()
+	delete(r.down, upstream)
+	r.lock.Unlock()
+}
+
+// / A north relay that connects once the engine knows the destination - see proxy.Router
+type routedNorth struct {
+	router *UpstreamRouter
+	dial   func(upstream string) (relay2.Relay, error)
+	north  relay2.Relay
+
+	lock      sync.Mutex    /// so Close can't miss a north that Route is just connecting
+	ready     chan struct{} /// closed once north is connected
+	done      chan struct{}
+	closeonce sync.Once
+
+	debuglogs bool
+	debugname string
+}
+
+func newRoutedNorth(router *UpstreamRouter, dial func(upstream string) (relay2.Relay, error)) *routedNorth {
+	return &routedNorth{
+		router: router,
+		dial:   dial,
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (r *routedNorth) Route(target string) error {
+	route, upstreams := r.router.Candidates(target)
+	lasterr := fmt.Errorf("route %s has no upstreams", route)
+	for _, upstream := range upstreams {
+		north, err := r.dial(upstream)
+		if err != nil {
+			r.router.MarkDown(upstream, err)
+			lasterr = err
+			continue
+		}
+		r.router.MarkUp(upstream)
+		r.lock.Lock()
+		select {
+		case <-r.done:
+			r.lock.Unlock()
+			north.Close() /// closed while we were connecting
+			return fmt.Errorf("closed before %s was routed", target)
+		default:
+		}
+		fmt.Println("Routing", target, "via", route, "to", upstream)
+		north.EnableDebugLogs(r.debuglogs, r.debugname)
+		r.north = north
+		close(r.ready)
+		r.lock.Unlock()
+		return nil
+	}
+	return lasterr
+}
+
+// / Nothing to do until Route
+func (r *routedNorth) Connect() error {
+	return nil
+}
+
+func (r *routedNorth) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closeonce.Do(func() { close(r.done) })
+	select {
+	case <-r.ready:
+		r.north.Close()
+	default:
+	}
+}
+
+func (r *routedNorth) SendMsg(data []byte) error {
+	select {
+	case <-r.ready:
+		return r.north.SendMsg(data)
+	default:
+		return fmt.Errorf("upstream not routed yet")
+	}
+}
+
+func (r *routedNorth) RecvMsg() ([]byte, error) {
+	select {
+	case <-r.ready:
+		return r.north.RecvMsg()
+	case <-r.done:
+		return nil, io.EOF
+	}
+}
+
+func (r *routedNorth) EnableDebugLogs(enable bool, name string) {
+	r.debuglogs, r.debugname = enable, name
+}
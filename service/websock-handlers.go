@@ -13,7 +13,7 @@ import (
 ///WARNING - these hanven't been tested yet
 
 // / Raw websocket proxy - north and south
-func (p *Service) HandleWsProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent) {
+func (p *Service) HandleWsProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent, params map[string]string) {
 	defer util.OnPanic(w)
 	fmt.Println("Handling ws proxy")
 	north := relay2.NewWebSockRelay(proxycfg.Proxyendpoint, p.getTimeout(proxycfg))
@@ -30,13 +30,14 @@ func (p *Service) HandleWsProxy(w http.ResponseWriter, req *http.Request, proxyc
 		return
 	}
 	south := relay2.NewWebSockRelayFromConn(conn, p.timeout)
-	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesproc)
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(proxycfg.RuleSet))
+	processor.SetClient(maskKey(params[p.proxyparam]), req.RemoteAddr)
 	go processor.ProcessNorthbound()
 	go processor.ProcessSouthbound()
 }
 
 // Websocket to the north - raw tcp to the south
-func (p *Service) HandleNetWSProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent) {
+func (p *Service) HandleNetWSProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent, params map[string]string) {
 	defer util.OnPanic(w)
 	fmt.Println("Handling net ws proxy")
 	north := relay2.NewWebSockRelay(proxycfg.Proxyendpoint, p.getTimeout(proxycfg))
@@ -52,14 +53,15 @@ func (p *Service) HandleNetWSProxy(w http.ResponseWriter, req *http.Request, pro
 	util.CheckError(err)
 	// Only accept secure connections - make sure this is a tls connection
 	south := relay2.NewClientFromConn(conn.(*tls.Conn), p.getTimeout(proxycfg))
-	north.SendMsg(pendingdata)
-	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesproc)
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(proxycfg.RuleSet))
+	processor.SetClient(maskKey(params[p.proxyparam]), req.RemoteAddr)
+	processor.SetPending(pendingdata) /// already read from the south, so it goes through the rules like the rest
 	go processor.ProcessNorthbound()
 	go processor.ProcessSouthbound()
 }
 
 // Raw tcp to the north - websocket to the south
-func (p *Service) HandleWSNetProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent) {
+func (p *Service) HandleWSNetProxy(w http.ResponseWriter, req *http.Request, proxycfg *ProxyContent, params map[string]string) {
 	defer util.OnPanic(w)
 	fmt.Println("Handling ws net proxy")
 	conn, err := upgrader.Upgrade(w, req, nil)
@@ -69,7 +71,8 @@ func (p *Service) HandleWSNetProxy(w http.ResponseWriter, req *http.Request, pro
 	err = north.Connect()
 	util.CheckError(err)
 	south := relay2.NewWebSockRelayFromConn(conn, p.getTimeout(proxycfg))
-	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesproc)
+	processor := proxy.NewEngine(north, south, p.proxycfg, p.rulesets.Load().Get(proxycfg.RuleSet))
+	processor.SetClient(maskKey(params[p.proxyparam]), req.RemoteAddr)
 	go processor.ProcessNorthbound()
 	go processor.ProcessSouthbound()
 }